@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func newAdminHandler(vhosts *VHostRouter) http.Handler {
+	// only profiling is behind the token, the dashboard has to work in a browser
+	pprof := http.Handler(pprofHandler(vhosts))
+	if options.AdminToken != "" {
+		pprof = requireToken(options.AdminToken, pprof)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/servers/drain", drainHandler(vhosts))
+	mux.HandleFunc("/admin/servers/weight", weightHandler(vhosts))
+	mux.HandleFunc("/admin/backends", backendsHandler(vhosts))
+	mux.HandleFunc("/admin/replay", replayHandler(vhosts))
+	mux.HandleFunc("/admin/pool/promote-standby", promoteStandbyHandler(vhosts))
+	mux.HandleFunc("/admin/pools/{pool}/maintenance", maintenanceHandler(vhosts))
+	mux.Handle("/admin/ws/connections", connectionsStream(vhosts))
+	mux.HandleFunc("/admin/dashboard", dashboardHandler)
+	mux.Handle("/admin/backends/{url}/pprof/{profile}", pprof)
+	mux.HandleFunc("/metrics", metricsHandler(vhosts))
+	return mux
+}
+
+// requireToken only lets requests through that carry the admin API token as
+// a bearer Authorization header
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// findPool looks a pool up by name, an empty name is the default pool
+func findPool(vhosts *VHostRouter, name string) *ServerPool {
+	if name == "" {
+		return vhosts.fallback
+	}
+
+	for _, pool := range vhosts.Pools() {
+		if pool.Name == name {
+			return pool
+		}
+	}
+	return nil
+}
+
+// findServer looks a server up by URL across all pools
+func findServer(vhosts *VHostRouter, rawurl string) (*ServerPool, *Server) {
+	for _, pool := range vhosts.Pools() {
+		if server := pool.GetServer(rawurl); server != nil {
+			return pool, server
+		}
+	}
+	return nil, nil
+}
+
+// drainHandler serves PUT /admin/servers/drain?url=...&drain=true[&wait=30s].
+// With wait set the call blocks until in-flight requests on the server are done.
+func drainHandler(vhosts *VHostRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		_, server := findServer(vhosts, query.Get("url"))
+		if server == nil {
+			http.Error(w, "Unknown server", http.StatusNotFound)
+			return
+		}
+
+		drain, err := strconv.ParseBool(query.Get("drain"))
+		if err != nil {
+			http.Error(w, "Invalid drain value", http.StatusBadRequest)
+			return
+		}
+
+		server.SetDraining(drain)
+		log.Printf("%s draining=%t\n", server.URL, drain)
+
+		if wait := query.Get("wait"); drain && wait != "" {
+			timeout, err := time.ParseDuration(wait)
+			if err != nil {
+				http.Error(w, "Invalid wait value", http.StatusBadRequest)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			if err := server.WaitDrained(ctx); err != nil {
+				http.Error(w, "Server not drained: "+err.Error(), http.StatusGatewayTimeout)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// weightHandler serves PUT /admin/servers/weight?url=...&weight=3
+func weightHandler(vhosts *VHostRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		_, server := findServer(vhosts, query.Get("url"))
+		if server == nil {
+			http.Error(w, "Unknown server", http.StatusNotFound)
+			return
+		}
+
+		weight, err := strconv.Atoi(query.Get("weight"))
+		if err != nil || weight <= 0 {
+			http.Error(w, "Invalid weight value", http.StatusBadRequest)
+			return
+		}
+
+		server.SetWeight(weight)
+		log.Printf("%s weight=%d\n", server.URL, weight)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type poolStatus struct {
+	Pool     string         `json:"pool"`
+	Backends []ServerStatus `json:"backends"`
+}
+
+// backendsHandler serves GET /admin/backends with the status of every server
+func backendsHandler(vhosts *VHostRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var pools []poolStatus
+		for _, pool := range vhosts.Pools() {
+			status := poolStatus{Pool: pool.Name}
+			for _, s := range pool.Servers() {
+				status.Backends = append(status.Backends, s.Status())
+			}
+			pools = append(pools, status)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pools)
+	}
+}
+
+type replayRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	// optional, the request goes through the normal routing when empty
+	Backend string `json:"backend"`
+}
+
+// replayHandler serves POST /admin/replay. The described request is sent
+// through the load balancer and the backend response is returned as is.
+func replayHandler(vhosts *VHostRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var replay replayRequest
+		if err := json.NewDecoder(r.Body).Decode(&replay); err != nil {
+			http.Error(w, "Invalid replay request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if replay.Method == "" {
+			replay.Method = http.MethodGet
+		}
+
+		ctx := context.WithValue(r.Context(), Replayed, true)
+		req, err := http.NewRequestWithContext(ctx, replay.Method, replay.Path, strings.NewReader(replay.Body))
+		if err != nil {
+			http.Error(w, "Invalid replay request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for name, value := range replay.Headers {
+			req.Header.Set(name, value)
+		}
+		req.Host = req.Header.Get("Host")
+		req.RemoteAddr = r.RemoteAddr
+		req.RequestURI = replay.Path
+
+		log.Printf("%s replaying %s %s %s\n", r.RemoteAddr, replay.Method, replay.Path, replay.Backend)
+		res := newResponseBuffer()
+		if replay.Backend == "" {
+			loadBalance(res, req)
+		} else {
+			pool, server := findServer(vhosts, replay.Backend)
+			if server == nil {
+				http.Error(w, "Unknown server", http.StatusNotFound)
+				return
+			}
+			serve(res, req, pool, server)
+		}
+		res.writeTo(w)
+	}
+}
+
+// promoteStandbyHandler serves PUT /admin/pool/promote-standby[?pool=name],
+// making the next standby server of a hot-standby pool its primary
+func promoteStandbyHandler(vhosts *VHostRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		pool := findPool(vhosts, r.URL.Query().Get("pool"))
+		if pool == nil {
+			http.Error(w, "Unknown pool", http.StatusNotFound)
+			return
+		}
+
+		previous := pool.PromoteStandby()
+		if previous == nil {
+			http.Error(w, "No alive server", http.StatusConflict)
+			return
+		}
+
+		log.Printf("[%s] %s demoted to standby, %s is primary\n", pool.Name, previous.URL, pool.PrimaryServer().URL)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type maintenanceRequest struct {
+	Enabled bool `json:"enabled"`
+	// optional status page requests are redirected to
+	RedirectTo string `json:"redirect_to"`
+}
+
+// maintenanceHandler serves PUT /admin/pools/{pool}/maintenance, keeping all
+// requests of a pool away from its backends while enabled
+func maintenanceHandler(vhosts *VHostRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		pool := findPool(vhosts, r.PathValue("pool"))
+		if pool == nil {
+			http.Error(w, "Unknown pool", http.StatusNotFound)
+			return
+		}
+
+		var req maintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid maintenance request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		pool.SetMaintenance(req.Enabled, req.RedirectTo)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminTokenOnlyProtectsProfiling(t *testing.T) {
+	setOptions(t, func(o *Options) { o.AdminToken = "secret" })
+	pool, err := newServerPool("default", PoolConfig{Backends: []BackendConfig{{URL: "http://127.0.0.1:9001"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setPool(t, pool)
+	handler := newAdminHandler(vhosts)
+
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		want  int
+	}{
+		{"dashboard", "/admin/dashboard", "", http.StatusOK},
+		{"backends", "/admin/backends", "", http.StatusOK},
+		{"profile without token", "/admin/backends/http%3A%2F%2F127.0.0.1%3A9001/pprof/heap", "", http.StatusUnauthorized},
+		{"profile with wrong token", "/admin/backends/http%3A%2F%2F127.0.0.1%3A9001/pprof/heap", "guess", http.StatusUnauthorized},
+		{"unknown profile with token", "/admin/backends/http%3A%2F%2F127.0.0.1%3A9001/pprof/nope", "secret", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
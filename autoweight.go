@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+const AUTO_WEIGHT_INTERVAL = 60 * time.Second
+
+// share of the base weight a server keeps however slow it is
+const MIN_AUTO_WEIGHT = 0.1
+
+// AutoWeight adjusts the weights of the servers every AUTO_WEIGHT_INTERVAL
+// with -auto-weight, used by the weighted-random strategy
+func (p *ServerPool) AutoWeight() {
+	t := time.NewTicker(AUTO_WEIGHT_INTERVAL)
+	for range t.C {
+		p.tuneWeights()
+	}
+}
+
+// tuneWeights sets the weight of each alive server to its base weight times
+// the median P99 latency of the alive servers over its own P99, so slower
+// servers get less traffic. Weights are kept to at least MIN_AUTO_WEIGHT of
+// the base weight.
+func (p *ServerPool) tuneWeights() {
+	p99s := make(map[*Server]time.Duration)
+	var sorted []time.Duration
+	for _, s := range p.Servers() {
+		if !s.IsAlive() {
+			continue
+		}
+		if p99 := s.LatencyPercentile(0.99); p99 > 0 {
+			p99s[s] = p99
+			sorted = append(sorted, p99)
+		}
+	}
+	if len(sorted) < 2 {
+		return
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	}
+
+	for s, p99 := range p99s {
+		factor := math.Max(float64(median)/float64(p99), MIN_AUTO_WEIGHT)
+		weight := int(math.Max(1, math.Round(float64(s.BaseWeight())*factor)))
+		if previous := s.SetAutoWeight(weight); previous != weight {
+			log.Printf("[%s] %s weight %d -> %d, P99 %s against a median of %s\n", p.Name, s.URL, previous, weight, p99, median)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// isJSON reports whether the response carries an uncompressed JSON body
+func isJSON(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json" && resp.Header.Get("Content-Encoding") == ""
+}
+
+// replaceBody swaps the response body and fixes up its length
+func replaceBody(resp *http.Response, data []byte) {
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// MAX_NORMALIZED_BODY bounds the response bodies decompressed by
+// NormalizeResponseEncoding, longer ones are passed on compressed
+const MAX_NORMALIZED_BODY = 10 << 20
+
+// NormalizeResponseEncoding decompresses gzip responses sent to clients that
+// didn't ask for gzip, for backends with a misconfigured compression. Bodies
+// that can't be decompressed are passed on as they came.
+func (route *Route) NormalizeResponseEncoding(resp *http.Response) {
+	if !route.NormalizeEncoding || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return
+	}
+	if acceptsGzip(resp.Request.Header.Get("Accept-Encoding")) {
+		return
+	}
+
+	compressed, err := io.ReadAll(io.LimitReader(resp.Body, MAX_NORMALIZED_BODY+1))
+	if err != nil || len(compressed) > MAX_NORMALIZED_BODY {
+		resp.Body = limitedBody{io.MultiReader(bytes.NewReader(compressed), resp.Body), resp.Body}
+		if err != nil {
+			log.Printf("[%s] could not read response body: %s\n", resp.Request.URL.Host, err)
+		}
+		return
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(compressed))
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		log.Printf("[%s] could not decompress response: %s\n", resp.Request.URL.Host, err)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(zr, MAX_NORMALIZED_BODY+1))
+	if err != nil {
+		log.Printf("[%s] could not decompress response: %s\n", resp.Request.URL.Host, err)
+		return
+	}
+	if len(data) > MAX_NORMALIZED_BODY {
+		log.Printf("WARN [%s] response to %s decompresses to more than %d bytes, passing it on compressed\n", resp.Request.URL.Host, resp.Request.URL.Path, MAX_NORMALIZED_BODY)
+		return
+	}
+
+	resp.Header.Del("Content-Encoding")
+	replaceBody(resp, data)
+}
+
+// limitedBody cuts a response body short while still closing the original
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// truncateBody cuts response bodies longer than -truncate-response-body and
+// flags them with a Warning header. Bodies of unknown length are read up to
+// the limit to find out whether they are longer.
+func truncateBody(resp *http.Response) {
+	limit := options.TruncateResponseBody
+	if limit <= 0 || resp.Request.Method == http.MethodHead || resp.ContentLength == 0 {
+		return
+	}
+	if resp.ContentLength > 0 && resp.ContentLength <= limit {
+		return
+	}
+
+	if resp.ContentLength < 0 {
+		data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+		if err != nil {
+			log.Printf("[%s] could not read response body: %s\n", resp.Request.URL.Host, err)
+			return
+		}
+		if int64(len(data)) <= limit {
+			resp.Body = limitedBody{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+			return
+		}
+		replaceBody(resp, data[:limit])
+	} else {
+		resp.Body = limitedBody{&io.LimitedReader{R: resp.Body, N: limit}, resp.Body}
+		resp.ContentLength = limit
+		resp.Header.Set("Content-Length", strconv.FormatInt(limit, 10))
+	}
+
+	log.Printf("[%s] response body of %s truncated to %d bytes\n", resp.Request.URL.Host, resp.Request.URL.Path, limit)
+	resp.Header.Add("Warning", `214 - "Transformation Applied"`)
+}
+
+// MAX_LOGGED_BODY bounds the response bodies read by LogResponseFields
+const MAX_LOGGED_BODY = 4 << 10
+
+// LogResponseBodyFields writes an access log entry with the LogResponseFields of
+// JSON responses. Bodies over MAX_LOGGED_BODY can't be decoded and are logged
+// without their fields.
+func (route *Route) LogResponseBodyFields(resp *http.Response) {
+	if len(route.LogResponseFields) == 0 || !isJSON(resp) {
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MAX_LOGGED_BODY))
+	resp.Body = limitedBody{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+	if err != nil {
+		log.Printf("[%s] could not read response body: %s\n", resp.Request.URL.Host, err)
+		return
+	}
+
+	r := resp.Request
+	var entry strings.Builder
+	fmt.Fprintf(&entry, "event=access client=%s method=%s path=%s status=%d backend=%s", clientIP(r), r.Method, r.URL.Path, resp.StatusCode, r.URL.Host)
+
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		log.Printf("WARN [%s] response to %s is not valid JSON within %d bytes, logging no fields\n", r.URL.Host, r.URL.Path, MAX_LOGGED_BODY)
+	} else {
+		for _, path := range route.LogResponseFields {
+			if value, ok := evalJSONPath(doc, path); ok {
+				fmt.Fprintf(&entry, " %s=%q", strings.TrimPrefix(path, "$."), jsonValueString(value))
+			}
+		}
+	}
+	log.Println(entry.String())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipResponse(body []byte) *http.Response {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Encoding": {"gzip"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    httptest.NewRequest(http.MethodGet, "/", nil),
+	}
+	resp.ContentLength = int64(len(body))
+	return resp
+}
+
+func TestNormalizeResponseEncoding(t *testing.T) {
+	route := &Route{RouteOptions: RouteOptions{NormalizeEncoding: true}}
+	plain := []byte(`{"ok": true}`)
+	compressed := gzipped(t, plain)
+	large := gzipped(t, make([]byte, MAX_NORMALIZED_BODY+1))
+
+	tests := []struct {
+		name     string
+		body     []byte
+		want     []byte
+		encoding string
+	}{
+		{"gzip", compressed, plain, ""},
+		{"corrupted", compressed[:len(compressed)-4], compressed[:len(compressed)-4], "gzip"},
+		{"not gzip", plain, plain, "gzip"},
+		{"too large once decompressed", large, large, "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := gzipResponse(tt.body)
+			route.NormalizeResponseEncoding(resp)
+
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got a body of %d bytes, want %d", len(got), len(tt.want))
+			}
+			if encoding := resp.Header.Get("Content-Encoding"); encoding != tt.encoding {
+				t.Errorf("got Content-Encoding %q, want %q", encoding, tt.encoding)
+			}
+		})
+	}
+}
+
+func TestRenderBody(t *testing.T) {
+	route, err := NewRoute("/", RouteOptions{ResponseBodyTemplate: `{"id": "{{.user_id}}"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := []byte(`{"user_id": 7, "padding": "` + strings.Repeat("x", MAX_TEMPLATE_BODY) + `"}`)
+
+	tests := []struct {
+		name string
+		body []byte
+		want []byte
+	}{
+		{"json", []byte(`{"user_id": 7}`), []byte(`{"id": "7"}`)},
+		{"not json", []byte(`user_id=7`), []byte(`user_id=7`)},
+		{"too large", large, large},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"application/json"}},
+				Body:       io.NopCloser(bytes.NewReader(tt.body)),
+				Request:    httptest.NewRequest(http.MethodGet, "/", nil),
+			}
+			route.RenderBody(resp)
+
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got a body of %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type CircuitBreakerConfig struct {
+	// share of failed requests, 0.0 to 1.0, that opens the circuit
+	ErrorThreshold float64       `yaml:"error_threshold"`
+	OpenDuration   time.Duration `yaml:"open_duration"`
+	Window         time.Duration `yaml:"window"`
+	// fewer requests than this within the window never open the circuit
+	MinRequests int64 `yaml:"min_requests"`
+}
+
+// RouteCircuitBreaker rejects all requests to a route while its error rate is
+// too high, whatever the health of the individual backends
+type RouteCircuitBreaker struct {
+	ErrorThreshold float64
+	OpenDuration   time.Duration
+	MinRequests    int64
+
+	path      string
+	window    *slidingWindow
+	mux       sync.Mutex
+	openUntil time.Time
+}
+
+func NewRouteCircuitBreaker(path string, config CircuitBreakerConfig) *RouteCircuitBreaker {
+	if config.OpenDuration <= 0 {
+		config.OpenDuration = 30 * time.Second
+	}
+	if config.Window <= 0 {
+		config.Window = 10 * time.Second
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = 10
+	}
+
+	return &RouteCircuitBreaker{
+		ErrorThreshold: config.ErrorThreshold,
+		OpenDuration:   config.OpenDuration,
+		MinRequests:    config.MinRequests,
+		path:           path,
+		window:         newSlidingWindow(config.Window),
+	}
+}
+
+// Allow reports whether the circuit is closed. Once OpenDuration has passed
+// the circuit closes again with a fresh window.
+func (b *RouteCircuitBreaker) Allow() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(b.openUntil) {
+		return false
+	}
+
+	b.openUntil = time.Time{}
+	b.window.Reset()
+	log.Printf("[%s] route circuit closed\n", b.path)
+	return true
+}
+
+// Record counts a finished request and opens the circuit when the error rate exceeds the threshold
+func (b *RouteCircuitBreaker) Record(failed bool) {
+	now := time.Now()
+	b.window.Add(now, failed)
+
+	total, errors := b.window.Counts(now)
+	if total < b.MinRequests || float64(errors)/float64(total) <= b.ErrorThreshold {
+		return
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.openUntil.IsZero() {
+		b.openUntil = now.Add(b.OpenDuration)
+		log.Printf("[%s] route circuit open for %s, %d of %d requests failed\n", b.path, b.OpenDuration, errors, total)
+	}
+}
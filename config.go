@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the optional YAML configuration passed with -config. Its top-level
+// pool settings describe the default pool.
+type Config struct {
+	PoolConfig   `yaml:",inline"`
+	VirtualHosts []VirtualHostConfig `yaml:"virtual_hosts"`
+	// pools only reached through routing rules like jwt_claim_route
+	Pools     []NamedPoolConfig `yaml:"pools"`
+	Transport TransportConfig   `yaml:"transport"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{Transport: DefaultTransportConfig()}
+}
+
+type PoolConfig struct {
+	Strategy             string          `yaml:"strategy"`
+	Mode                 string          `yaml:"mode"`
+	Type                 string          `yaml:"type"`
+	Backends             []BackendConfig `yaml:"backends"`
+	Routes               []RouteConfig   `yaml:"routes"`
+	HealthCheckInterval  time.Duration   `yaml:"health_check_interval"`
+	HealthCheckTimeout   time.Duration   `yaml:"health_check_timeout"`
+	HealthScoreThreshold float64         `yaml:"health_score_threshold"`
+	// send requests with a JWT claim value to a named pool
+	JWTClaimRoute *JWTClaimRouteConfig `yaml:"jwt_claim_route"`
+	// send reads to a replica pool, only for pools of type primary
+	ReadWriteSplit *ReadWriteSplitConfig `yaml:"read_write_split"`
+
+	RouteOptions `yaml:",inline"`
+}
+
+type VirtualHostConfig struct {
+	Host       string `yaml:"host"`
+	PoolConfig `yaml:",inline"`
+}
+
+type NamedPoolConfig struct {
+	Name       string `yaml:"name"`
+	PoolConfig `yaml:",inline"`
+}
+
+type BackendConfig struct {
+	URL       string  `yaml:"url"`
+	Weight    int     `yaml:"weight"`
+	Priority  int     `yaml:"priority"`
+	EWMAAlpha float64 `yaml:"ewma_alpha"`
+	UseHTTP2  bool    `yaml:"use_http2"`
+	SLOP99Ms  int     `yaml:"slo_p99_ms"`
+	// HTTP health check, a TCP connect is used when both are empty
+	HealthCheckPath      string `yaml:"health_check_path"`
+	HealthCheckJSONPath  string `yaml:"json_path"`
+	HealthCheckJSONValue string `yaml:"json_value"`
+	// failed health checks don't mark the backend down for this long after it is added
+	InitialGracePeriod time.Duration `yaml:"initial_grace_period"`
+	// requests proxied to the backend are also logged there
+	LogFile string `yaml:"log_file"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := DefaultConfig()
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const FAILURE_CHANNEL = "toylb:backend-failures"
+
+type failureMessage struct {
+	URL string        `json:"url"`
+	TTL time.Duration `json:"ttl"`
+}
+
+// Coordinator shares backend failures between the LB instances of a cluster
+// over Redis pub/sub. Every instance lowers the weight of a failed backend
+// until the TTL of the failure expires. Redis is optional.
+type Coordinator struct {
+	client *redis.Client
+	vhosts *VHostRouter
+	ttl    time.Duration
+}
+
+func NewCoordinator(addr string, vhosts *VHostRouter, ttl time.Duration) *Coordinator {
+	return &Coordinator{
+		client: redis.NewClient(&redis.Options{Addr: addr}),
+		vhosts: vhosts,
+		ttl:    ttl,
+	}
+}
+
+// Run publishes the backends this instance sees going down and applies the
+// failures published by all instances, until ctx is done
+func (c *Coordinator) Run(ctx context.Context) {
+	sub := c.client.Subscribe(ctx, FAILURE_CHANNEL)
+	defer sub.Close()
+
+	local := events.Subscribe(64)
+	defer events.Unsubscribe(local)
+
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-local:
+			if e.Type == "backend_down" {
+				c.publish(ctx, e.Backend)
+			}
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			c.apply(msg.Payload)
+		}
+	}
+}
+
+func (c *Coordinator) publish(ctx context.Context, url string) {
+	data, err := json.Marshal(failureMessage{URL: url, TTL: c.ttl})
+	if err != nil {
+		return
+	}
+	if err := c.client.Publish(ctx, FAILURE_CHANNEL, data).Err(); err != nil {
+		log.Printf("[%s] could not publish failure to redis: %s\n", url, err)
+	}
+}
+
+func (c *Coordinator) apply(payload string) {
+	var msg failureMessage
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		log.Printf("Invalid failure message from redis: %s\n", err)
+		return
+	}
+
+	for _, pool := range c.vhosts.Pools() {
+		if server := pool.GetServer(msg.URL); server != nil {
+			server.PenalizeWeight(msg.TTL)
+			log.Printf("[%s] weight lowered for %s after a failure reported by the cluster\n", msg.URL, msg.TTL)
+		}
+	}
+}
+
+func (c *Coordinator) Close() error {
+	return c.client.Close()
+}
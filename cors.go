@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsAllowed reports whether the origin may make cross-origin requests
+func corsAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+
+	for _, allowed := range options.CORSAllowOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// handlePreflight answers CORS preflight requests at the LB. The max-age lets
+// browsers cache the answer instead of sending OPTIONS before every request.
+func handlePreflight(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if !corsAllowed(origin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	maxAge := strconv.Itoa(int(options.CORSMaxAge.Seconds()))
+	header := w.Header()
+	header.Set("Access-Control-Allow-Origin", origin)
+	header.Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		header.Set("Access-Control-Allow-Headers", headers)
+	}
+	header.Set("Access-Control-Max-Age", maxAge)
+	header.Set("Cache-Control", "max-age="+maxAge)
+	header.Add("Vary", "Origin")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addCORSHeaders lets the browser read responses to allowed origins
+func addCORSHeaders(resp *http.Response) {
+	origin := resp.Request.Header.Get("Origin")
+	if !corsAllowed(origin) {
+		return
+	}
+
+	resp.Header.Set("Access-Control-Allow-Origin", origin)
+	if !strings.Contains(resp.Header.Get("Vary"), "Origin") {
+		resp.Header.Add("Vary", "Origin")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+type backendConnections struct {
+	URL    string `json:"url"`
+	Active int64  `json:"active"`
+}
+
+type connectionsTick struct {
+	Timestamp        time.Time            `json:"timestamp"`
+	TotalConnections int64                `json:"total_connections"`
+	PerBackend       []backendConnections `json:"per_backend"`
+}
+
+func snapshotConnections(vhosts *VHostRouter) connectionsTick {
+	tick := connectionsTick{Timestamp: time.Now(), PerBackend: []backendConnections{}}
+	for _, pool := range vhosts.Pools() {
+		for _, s := range pool.Servers() {
+			active := s.GetActiveConns()
+			tick.TotalConnections += active
+			tick.PerBackend = append(tick.PerBackend, backendConnections{URL: s.URL.String(), Active: active})
+		}
+	}
+	return tick
+}
+
+// connectionsStream serves GET /admin/ws/connections, a WebSocket sending the
+// requests in flight every second until a write fails
+func connectionsStream(vhosts *VHostRouter) websocket.Handler {
+	return func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			if err := websocket.JSON.Send(ws, snapshotConnections(vhosts)); err != nil {
+				log.Printf("Connections stream to %s closed: %s\n", ws.Request().RemoteAddr, err)
+				return
+			}
+			<-t.C
+		}
+	}
+}
+
+// dashboardHandler serves GET /admin/dashboard, a chart of the connections stream
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardPage))
+}
+
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>toylb</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+svg { border: 1px solid #ccc; background: #fafafa; }
+td { padding: 0 1em 0 0; }
+</style>
+</head>
+<body>
+<h1>toylb</h1>
+<p>Requests in flight: <b id="total">-</b> <span id="state"></span></p>
+<svg id="chart" width="600" height="200"></svg>
+<table id="backends"></table>
+<script>
+const POINTS = 120;
+const colors = ["#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b"];
+const series = {total: []};
+
+function draw() {
+  const svg = document.getElementById("chart");
+  const w = svg.width.baseVal.value, h = svg.height.baseVal.value;
+  const max = Math.max(1, ...Object.values(series).flat());
+  svg.innerHTML = Object.keys(series).map((name, i) => {
+    const points = series[name].map((v, j) => (j * w / (POINTS - 1)) + "," + (h - v * (h - 10) / max)).join(" ");
+    const color = name === "total" ? "#000" : colors[(i - 1) % colors.length];
+    return '<polyline fill="none" stroke="' + color + '" points="' + points + '"/>';
+  }).join("");
+}
+
+function push(name, value) {
+  const s = series[name] = series[name] || [];
+  s.push(value);
+  if (s.length > POINTS) s.shift();
+}
+
+function connect() {
+  const ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/admin/ws/connections");
+  ws.onopen = () => document.getElementById("state").textContent = "";
+  ws.onclose = () => {
+    document.getElementById("state").textContent = "(disconnected)";
+    setTimeout(connect, 2000);
+  };
+  ws.onmessage = (msg) => {
+    const tick = JSON.parse(msg.data);
+    document.getElementById("total").textContent = tick.total_connections;
+    push("total", tick.total_connections);
+    const rows = [];
+    tick.per_backend.forEach((b) => {
+      push(b.url, b.active);
+      const i = Object.keys(series).indexOf(b.url);
+      rows.push('<tr><td style="color:' + colors[(i - 1) % colors.length] + '">&#9632;</td><td>' + b.url + '</td><td>' + b.active + '</td></tr>');
+    });
+    document.getElementById("backends").innerHTML = rows.join("");
+    draw();
+  };
+}
+connect();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// MAX_ENVELOPE_BODY bounds the envelopes read by unwrapEnvelope
+const MAX_ENVELOPE_BODY = 1 << 20
+
+// requestEnvelope is a request wrapped in the body of another one:
+// {"auth_token":"...","payload":{"method":"GET","path":"/resource"}}
+type requestEnvelope struct {
+	AuthToken string `json:"auth_token"`
+	Payload   struct {
+		Method  string            `json:"method"`
+		Path    string            `json:"path"`
+		Headers map[string]string `json:"headers"`
+		// a JSON string is sent as is, any other JSON value encoded
+		Body json.RawMessage `json:"body"`
+	} `json:"payload"`
+}
+
+// unwrapEnvelope is the UnwrapRequest hook of routes with unwrap_envelope. The
+// request it returns keeps the context, RemoteAddr and Host of the envelope
+// request, auth_token becomes a bearer Authorization header.
+func unwrapEnvelope(r *http.Request) (*http.Request, error) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, MAX_ENVELOPE_BODY))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope requestEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %w", err)
+	}
+	payload := envelope.Payload
+	if payload.Path == "" {
+		return nil, errors.New("invalid envelope: no payload path")
+	}
+	if payload.Method == "" {
+		payload.Method = http.MethodGet
+	}
+
+	u, err := url.ParseRequestURI(payload.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope path: %w", err)
+	}
+
+	var body []byte
+	if len(payload.Body) > 0 && string(payload.Body) != "null" {
+		var text string
+		if err := json.Unmarshal(payload.Body, &text); err == nil {
+			body = []byte(text)
+		} else {
+			body = payload.Body
+		}
+	}
+
+	unwrapped := r.Clone(r.Context())
+	unwrapped.Method = payload.Method
+	unwrapped.URL.Path, unwrapped.URL.RawPath, unwrapped.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+	unwrapped.RequestURI = u.RequestURI()
+	unwrapped.Body = io.NopCloser(bytes.NewReader(body))
+	unwrapped.ContentLength = int64(len(body))
+	unwrapped.Header.Del("Content-Length")
+	for name, value := range payload.Headers {
+		unwrapped.Header.Set(name, value)
+	}
+	if envelope.AuthToken != "" {
+		unwrapped.Header.Set("Authorization", "Bearer "+envelope.AuthToken)
+	}
+	return unwrapped, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type Event struct {
+	Type    string    `json:"type"`
+	Pool    string    `json:"pool,omitempty"`
+	Backend string    `json:"backend,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// EventBus fans out events to its subscribers. Publishing never blocks, a
+// subscriber that falls behind misses events.
+type EventBus struct {
+	mux         sync.RWMutex
+	subscribers []chan Event
+}
+
+var events EventBus
+
+func (b *EventBus) Subscribe(buffer int) <-chan Event {
+	ch := make(chan Event, buffer)
+
+	b.mux.Lock()
+	b.subscribers = append(b.subscribers, ch)
+	b.mux.Unlock()
+	return ch
+}
+
+func (b *EventBus) Unsubscribe(ch <-chan Event) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	for i, sub := range b.subscribers {
+		if sub == ch {
+			b.subscribers = append(b.subscribers[:i], b.subscribers[i+1:]...)
+			close(sub)
+			return
+		}
+	}
+}
+
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	log.Printf("event=%s pool=%s backend=%s %s\n", e.Type, e.Pool, e.Backend, e.Message)
+
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+
+	for _, sub := range b.subscribers {
+		select {
+		case sub <- e:
+		default:
+		}
+	}
+}
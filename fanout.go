@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"golang.org/x/sync/errgroup"
+)
+
+type fanOutResult struct {
+	Backend string `json:"backend"`
+	Status  int    `json:"status"`
+}
+
+// only cache invalidations are sent to every backend
+func isFanOut(route *Route, r *http.Request) bool {
+	return route.FanOut && (r.Method == http.MethodDelete || r.Method == "PURGE")
+}
+
+// fanOut sends the request to all available servers of the pool at once and
+// waits for every response. It answers 200 when all of them are 2xx and 207
+// otherwise, both with the status of each backend.
+func fanOut(w http.ResponseWriter, r *http.Request, pool *ServerPool) {
+	var servers []*Server
+	for _, s := range pool.Servers() {
+		if s.IsAvailable() {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	// a backend that stays unreachable fails on its own instead of the
+	// request falling over to another backend
+	ctx := context.WithValue(r.Context(), Attempts, MAX_ATTEMPTS)
+
+	results := make([]fanOutResult, len(servers))
+	var g errgroup.Group
+	for i, server := range servers {
+		g.Go(func() error {
+			req := r.Clone(ctx)
+			req.Body = io.NopCloser(bytes.NewReader(body))
+
+			res := newResponseBuffer()
+			defer func() {
+				if err := recover(); err != nil {
+					if err != http.ErrAbortHandler {
+						panic(err)
+					}
+					res.code = http.StatusBadGateway
+				}
+				if res.code == 0 {
+					res.code = http.StatusOK
+				}
+				results[i] = fanOutResult{Backend: server.URL.String(), Status: res.code}
+			}()
+			serve(res, req, pool, server)
+			return nil
+		})
+	}
+	g.Wait()
+
+	code := http.StatusOK
+	for _, res := range results {
+		if res.Status < 200 || res.Status > 299 {
+			code = http.StatusMultiStatus
+		}
+	}
+	if code != http.StatusOK {
+		log.Printf("%s(%s) fan-out failed on some backends\n", clientIP(r), r.URL.Path)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Results []fanOutResult `json:"results"`
+	}{results})
+}
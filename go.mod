@@ -1,5 +1,19 @@
 module github.com/hindenbug/toylb
 
-go 1.17
+go 1.26.0
 
-require github.com/labstack/echo/v4 v4.5.0 // indirect
+require (
+	github.com/redis/go-redis/v9 v9.22.0
+	go.etcd.io/bbolt v1.5.0
+	golang.org/x/crypto v0.57.0
+	golang.org/x/net v0.59.0
+	golang.org/x/sync v0.23.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	go.uber.org/atomic v1.11.0 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
+)
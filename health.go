@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func writeStatus(w http.ResponseWriter, code int, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// healthzHandler is the liveness probe, the LB answers as long as it runs
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, "ok")
+}
+
+// readyzHandler is the readiness probe, ready while the default pool (or the
+// pool named by ?pool=) has at least one live backend. With only virtual
+// hosts configured any pool will do.
+func readyzHandler(vhosts *VHostRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var pools []*ServerPool
+		if name := r.URL.Query().Get("pool"); name != "" {
+			pool := findPool(vhosts, name)
+			if pool == nil {
+				writeStatus(w, http.StatusNotFound, "unknown pool")
+				return
+			}
+			pools = append(pools, pool)
+		} else if vhosts.fallback != nil {
+			pools = append(pools, vhosts.fallback)
+		} else {
+			pools = vhosts.Pools()
+		}
+
+		for _, pool := range pools {
+			if pool.AliveCount() > 0 {
+				writeStatus(w, http.StatusOK, "ok")
+				return
+			}
+		}
+		writeStatus(w, http.StatusServiceUnavailable, "no backends")
+	}
+}
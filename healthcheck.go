@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// MAX_HEALTH_CHECK_BODY bounds the health check responses read for JSON checks
+const MAX_HEALTH_CHECK_BODY = 64 << 10
+
+// isServerHealthy runs the HTTP health check of the server when it has one,
+// checking that its JSON response carries the expected value, and falls back
+// to a TCP connect otherwise
+func isServerHealthy(ctx context.Context, s *Server, timeout time.Duration) bool {
+	if s.HealthCheckPath == "" && s.HealthCheckJSONPath == "" {
+		return isServerAlive(ctx, s.URL, timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	path := s.HealthCheckPath
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL.JoinPath(path).String(), nil)
+	if err != nil {
+		log.Printf("Invalid health check path %s: %s\n", path, err)
+		return false
+	}
+
+	client := &http.Client{Transport: s.ReverseProxy.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println("Health check failed, error: ", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("Health check of %s returned %d\n", s.URL, resp.StatusCode)
+		return false
+	}
+	if s.HealthCheckJSONPath == "" {
+		return true
+	}
+
+	var doc interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MAX_HEALTH_CHECK_BODY)).Decode(&doc); err != nil {
+		log.Printf("Health check of %s returned invalid JSON: %s\n", s.URL, err)
+		return false
+	}
+
+	value, ok := evalJSONPath(doc, s.HealthCheckJSONPath)
+	if !ok {
+		log.Printf("Health check of %s is missing %s\n", s.URL, s.HealthCheckJSONPath)
+		return false
+	}
+	if got := jsonValueString(value); got != s.HealthCheckJSONValue {
+		log.Printf("Health check of %s returned %s=%s, expected %s\n", s.URL, s.HealthCheckJSONPath, got, s.HealthCheckJSONValue)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// only requests without side effects or a body are hedged
+func isHedgeable(r *http.Request) bool {
+	if _, ok := r.Context().Value(Hedged).(bool); ok {
+		return false
+	}
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.ContentLength == 0
+}
+
+// hedge sends the request to a backend and, if it has not answered within
+// -hedge-delay, to a second one as well. The first complete response wins,
+// unless -hedge-prefer-success is set and it is a 5xx: then the other
+// response is awaited for up to -hedge-response-wait.
+func hedge(w http.ResponseWriter, r *http.Request, pool *ServerPool) {
+	first := pool.SelectServer()
+	if first == nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	// cancelling the context stops the losing request
+	ctx, cancel := context.WithCancel(context.WithValue(r.Context(), Hedged, true))
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	results := make(chan *responseBuffer, 2)
+	send := func(server *Server) {
+		go func() {
+			res := newResponseBuffer()
+			defer func() {
+				// the proxy aborts when copying the body fails, e.g. for the cancelled loser
+				if err := recover(); err != nil {
+					if err != http.ErrAbortHandler {
+						panic(err)
+					}
+					res.code = http.StatusBadGateway
+					res.body.Reset()
+				}
+				results <- res
+			}()
+			serve(res, r, pool, server)
+		}()
+	}
+
+	send(first)
+	pending := 1
+
+	hedgeTimer := time.NewTimer(options.HedgeDelay)
+	defer hedgeTimer.Stop()
+
+	var failed *responseBuffer
+	var waitTimer <-chan time.Time
+	for pending > 0 {
+		select {
+		case <-hedgeTimer.C:
+			if second := pool.SelectServer(); second != nil && second != first {
+				send(second)
+				pending++
+			}
+		case res := <-results:
+			pending--
+			if !options.HedgePreferSuccess || res.code < http.StatusInternalServerError {
+				res.writeTo(w)
+				return
+			}
+			if failed == nil {
+				failed = res
+			}
+			if waitTimer == nil {
+				waitTimer = time.After(options.HedgeResponseWait)
+			}
+		case <-waitTimer:
+			pending = 0
+		}
+	}
+
+	failed.writeTo(w)
+}
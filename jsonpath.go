@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// evalJSONPath evaluates a minimal JSONPath expression like $.items[0].status
+// against a decoded JSON document. Only child members and array indexes are
+// supported.
+func evalJSONPath(doc interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+
+	for path != "" {
+		switch {
+		case path[0] == '.':
+			end := strings.IndexAny(path[1:], ".[")
+			if end < 0 {
+				end = len(path) - 1
+			}
+			key := path[1 : end+1]
+			path = path[end+1:]
+
+			object, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if doc, ok = object[key]; !ok {
+				return nil, false
+			}
+		case path[0] == '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return nil, false
+			}
+			index, err := strconv.Atoi(path[1:end])
+			path = path[end+1:]
+
+			array, ok := doc.([]interface{})
+			if err != nil || !ok || index < 0 || index >= len(array) {
+				return nil, false
+			}
+			doc = array[index]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// jsonValueString formats a value found by evalJSONPath for comparisons
+func jsonValueString(value interface{}) string {
+	if value == nil {
+		return "null"
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type JWTClaimRouteConfig struct {
+	Claim string `yaml:"claim"`
+	Value string `yaml:"value"`
+	// name of a pool from the pools section
+	Pool string `yaml:"pool"`
+}
+
+// JWTClaimRouter sends requests whose bearer token carries a claim with the
+// given value to another pool. The signature is not verified, the token is
+// expected to be validated upstream of the LB.
+type JWTClaimRouter struct {
+	JWTClaimRouteConfig
+}
+
+func NewJWTClaimRouter(config JWTClaimRouteConfig) (*JWTClaimRouter, error) {
+	if config.Claim == "" || config.Pool == "" {
+		return nil, fmt.Errorf("jwt_claim_route needs a claim and a pool")
+	}
+	return &JWTClaimRouter{config}, nil
+}
+
+// Match tells whether the request carries the claim value
+func (j *JWTClaimRouter) Match(r *http.Request) bool {
+	claims, ok := jwtClaims(r)
+	if !ok {
+		return false
+	}
+
+	value, ok := claims[j.Claim]
+	return ok && fmt.Sprint(value) == j.Value
+}
+
+// jwtClaims decodes the payload of the bearer token of the request
+func jwtClaims(r *http.Request) (map[string]interface{}, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, false
+	}
+
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, false
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, false
+	}
+	return claims, true
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// setKeepAliveCount sets TCP_KEEPCNT, the number of unanswered keepalive
+// probes before the kernel drops the connection
+func setKeepAliveCount(conn *net.TCPConn, count int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// TCP_KEEPCNT is only tuned on Linux, elsewhere the OS default applies
+func setKeepAliveCount(conn *net.TCPConn, count int) error {
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const LATENCY_SAMPLES = 1024
+
+// latencySamples keeps the latest LATENCY_SAMPLES request latencies of a
+// server, enough for percentiles of its recent traffic
+type latencySamples struct {
+	samples [LATENCY_SAMPLES]latencySample
+	next    int
+	count   int
+}
+
+type latencySample struct {
+	latency time.Duration
+	at      time.Time
+}
+
+func (l *latencySamples) Add(d time.Duration, at time.Time) {
+	l.samples[l.next] = latencySample{latency: d, at: at}
+	l.next = (l.next + 1) % LATENCY_SAMPLES
+	if l.count < LATENCY_SAMPLES {
+		l.count++
+	}
+}
+
+// Percentile returns the latency below which p (0 to 1) of the samples taken
+// after since fall, 0 without such samples
+func (l *latencySamples) Percentile(p float64, since time.Time) time.Duration {
+	var sorted []time.Duration
+	for _, sample := range l.samples[:l.count] {
+		if sample.at.After(since) {
+			sorted = append(sorted, sample.latency)
+		}
+	}
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// LatencyPercentile returns a percentile of the recent latencies of the server
+func (s *Server) LatencyPercentile(p float64) time.Duration {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.latencies.Percentile(p, time.Time{})
+}
+
+// checkSLO compares the P99 latency of the requests since the previous check
+// to the slo_p99_ms target of the server, called on every health check. An
+// idle server isn't checked, its old samples were checked already.
+func (s *Server) checkSLO(pool string) {
+	if s.SLOP99 <= 0 {
+		return
+	}
+
+	now := time.Now()
+	s.mux.Lock()
+	p99 := s.latencies.Percentile(0.99, s.sloCheckedAt)
+	s.sloCheckedAt = now
+	s.mux.Unlock()
+	if p99 <= s.SLOP99 {
+		return
+	}
+
+	atomic.AddUint64(&s.SLOViolations, 1)
+	log.Printf("WARN [%s] %s P99 latency %s above the SLO of %s\n", pool, s.URL, p99, s.SLOP99)
+	events.Publish(Event{Type: "backend_slo_violation", Pool: pool, Backend: s.URL.String(), Message: fmt.Sprintf("p99 %s above %s", p99, s.SLOP99)})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckSLOOnlyNewSamples(t *testing.T) {
+	server := &Server{URL: &url.URL{Scheme: "http", Host: "backend"}, SLOP99: 100 * time.Millisecond, EWMAAlpha: DEFAULT_EWMA_ALPHA}
+	violations := func() uint64 { return atomic.LoadUint64(&server.SLOViolations) }
+
+	// one slow burst, then the server goes idle
+	for i := 0; i < 10; i++ {
+		server.ObserveLatency(time.Second)
+	}
+	server.checkSLO("default")
+	if violations() != 1 {
+		t.Fatalf("got %d violations after the burst, want 1", violations())
+	}
+
+	for i := 0; i < 3; i++ {
+		server.checkSLO("default")
+	}
+	if violations() != 1 {
+		t.Errorf("got %d violations while idle, want the burst counted once", violations())
+	}
+
+	for i := 0; i < 10; i++ {
+		server.ObserveLatency(10 * time.Millisecond)
+	}
+	server.checkSLO("default")
+	if violations() != 1 {
+		t.Errorf("got %d violations after fast requests, want 1", violations())
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// connRate estimates the connections opened by one client in the last second,
+// weighting the previous second by how much of it still falls in the window
+type connRate struct {
+	mux      sync.Mutex
+	second   int64
+	current  int64
+	previous int64
+}
+
+func (c *connRate) allow(now time.Time, limit int64) bool {
+	second := now.Unix()
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	switch {
+	case second == c.second+1:
+		c.previous, c.current = c.current, 0
+	case second != c.second:
+		c.previous, c.current = 0, 0
+	}
+	c.second = second
+
+	elapsed := float64(now.UnixNano()%int64(time.Second)) / float64(time.Second)
+	estimate := float64(c.previous)*(1-elapsed) + float64(c.current)
+	if estimate >= float64(limit) {
+		return false
+	}
+	c.current++
+	return true
+}
+
+func (c *connRate) idleSince(second int64) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.second < second
+}
+
+// connLimitListener resets connections from clients opening more than limit
+// new connections per second, before any HTTP parsing happens
+type connLimitListener struct {
+	net.Listener
+	limit int64
+	rates sync.Map
+}
+
+func newConnLimitListener(l net.Listener, limit int64) *connLimitListener {
+	cl := &connLimitListener{Listener: l, limit: limit}
+	go cleanupRates(&cl.rates)
+	return cl
+}
+
+func (cl *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := cl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+
+		rate, _ := cl.rates.LoadOrStore(ip, &connRate{})
+		if rate.(*connRate).allow(time.Now(), cl.limit) {
+			return conn, nil
+		}
+
+		log.Printf("%s exceeded %d new connections per second, resetting\n", ip, cl.limit)
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			// close with RST instead of FIN
+			tcpConn.SetLinger(0)
+		}
+		conn.Close()
+	}
+}
+
+// cleanupRates forgets the clients of rates that have not been seen for a while
+func cleanupRates(rates *sync.Map) {
+	t := time.NewTicker(time.Minute)
+	for range t.C {
+		stale := time.Now().Unix() - 2
+		rates.Range(func(key, value interface{}) bool {
+			if value.(*connRate).idleSince(stale) {
+				rates.Delete(key)
+			}
+			return true
+		})
+	}
+}
+
+// listenUnixSocket listens on a Unix socket only the process owner and group
+// may connect to, replacing a socket left behind by a previous run
+func listenUnixSocket(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
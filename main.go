@@ -2,26 +2,85 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-var serverPool ServerPool
+// Options holds the flags that apply to every pool and backend
+type Options struct {
+	Strategy           string
+	Transport          TransportConfig
+	KeepAliveCount     int
+	LatencyEpsilon     float64
+	UpstreamHTTP2      bool
+	BackendH2          bool
+	HedgeDelay         time.Duration
+	HedgePreferSuccess bool
+	HedgeResponseWait  time.Duration
+	RequestTimeout     time.Duration
+	MaxNewConnsPerSec  int64
+	RateLimit          int64
+	TarpitDelay        time.Duration
+	MaxTarpitted       int64
+	BackendQueueSize   int
+	BackendWorkers     int
+	MaxPushResources   int
+	CORSAllowOrigins   []string
+	CORSMaxAge         time.Duration
+	RequestIDHeader    string
+	// bytes, 0 disables truncation
+	TruncateResponseBody int64
+	MaxRetryFactor       float64
+	MaxHops              int
+	AutoWeight           bool
+	AdminToken           string
+	BackendPipelining    bool
+	PipelineDepth        int
+	FollowRedirects      bool
+	MaxRedirects         int
+	OPAEndpoint          string
+	OPACacheTTL          time.Duration
+	OPATimeout           time.Duration
+	// TCP mode settings
+	TCPMode             bool
+	EmitProxyProtocol   bool
+	AcceptProxyProtocol bool
+}
+
+var options Options
+
+// serverPool is the default pool, nil when only virtual hosts are configured
+var serverPool *ServerPool
+var vhosts *VHostRouter
 
 const PORT uint = 8080
 const MAX_RETRIES = 3
 const MAX_ATTEMPTS = 3
+const SHUTDOWN_TIMEOUT = 10 * time.Second
 
 const (
 	Attempts int = iota
 	Retry
+	RequestStart
+	RouteKey
+	Hedged
+	RequestReceived
+	PusherKey
+	Redirects
+	Replayed
+	QueuedKey
 )
 
 func GetRetriesFromContext(r *http.Request) int {
@@ -40,13 +99,66 @@ func GetAttemptsFromContext(r *http.Request) int {
 	return 1
 }
 
-func isServerAlive(u *url.URL) bool {
-	timeout := 1 * time.Second
+func GetRouteFromContext(r *http.Request) *Route {
+	if route, ok := r.Context().Value(RouteKey).(*Route); ok {
+		return route
+	}
+
+	return noRoute
+}
+
+// isCancelled reports, and counts, requests whose client has gone away so
+// they aren't sent to a backend for nothing
+func isCancelled(r *http.Request) bool {
+	if !errors.Is(r.Context().Err(), context.Canceled) {
+		return false
+	}
+
+	// a hedged request that lost the race isn't a client cancellation
+	if _, ok := r.Context().Value(Hedged).(bool); !ok {
+		queued := time.Duration(0)
+		if received, ok := r.Context().Value(RequestReceived).(time.Time); ok {
+			queued = time.Since(received)
+		}
+		log.Printf("%s(%s) Request cancelled by the client after %s\n", clientIP(r), r.URL.Path, queued)
+		atomic.AddUint64(&requestsCancelled, 1)
+	}
+	return true
+}
+
+// HOPS_HEADER counts the load balancers a request went through
+const HOPS_HEADER = "X-LB-Hops"
+
+// countHop increments the hop count of the request, passed on to the backend,
+// and reports whether it is still within -max-hops
+func countHop(r *http.Request) bool {
+	hops, _ := strconv.Atoi(r.Header.Get(HOPS_HEADER))
+	hops++
+	r.Header.Set(HOPS_HEADER, strconv.Itoa(hops))
+	return hops <= options.MaxHops
+}
+
+// clientIP returns the address of the client without the port
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
 
-	conn, err := net.DialTimeout("tcp", u.Host, timeout)
+func isServerAlive(ctx context.Context, u *url.URL, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
 
 	if err != nil {
-		log.Println("Site unreachable, error: ", err)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Printf("Health check timed out after %s: %s\n", timeout, u)
+		} else {
+			log.Println("Site unreachable, error: ", err)
+		}
 		return false
 	}
 
@@ -56,84 +168,426 @@ func isServerAlive(u *url.URL) bool {
 
 func loadBalance(w http.ResponseWriter, r *http.Request) {
 	attempts := GetAttemptsFromContext(r)
+	if attempts == 1 {
+		ctx := context.WithValue(r.Context(), RequestReceived, time.Now())
+		// keep the client connection's pusher, the writer may get wrapped below
+		if pusher, ok := w.(http.Pusher); ok {
+			ctx = context.WithValue(ctx, PusherKey, pusher)
+		}
+		r = r.WithContext(ctx)
+
+		atomic.AddUint64(&requestsTotal, 1)
+		if retryLimiter != nil {
+			retryLimiter.Request()
+		}
+		setRequestID(w, r)
+		if len(options.CORSAllowOrigins) > 0 && isPreflight(r) {
+			atomic.AddUint64(&preflightRequests, 1)
+			handlePreflight(w, r)
+			return
+		}
+		// replays come from operators through the admin API, they aren't client traffic
+		_, replayed := r.Context().Value(Replayed).(bool)
+		if rateLimiter != nil && !replayed && !rateLimiter.Allow(clientIP(r)) {
+			rateLimiter.Reject(w, r)
+			return
+		}
+		if !countHop(r) {
+			log.Printf("%s(%s) more than %d hops, loop detected\n", clientIP(r), r.URL.Path, options.MaxHops)
+			http.Error(w, "Loop Detected", http.StatusLoopDetected)
+			return
+		}
+		if opaAuthorizer != nil && !opaAuthorizer.Allow(r) {
+			atomic.AddUint64(&requestsDenied, 1)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	if isCancelled(r) {
+		return
+	}
+
 	if attempts > MAX_ATTEMPTS {
 		log.Printf("%s(%s) Max attempts reached, terminating\n", r.RemoteAddr, r.URL.Path)
 		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
-	server := serverPool.NextServer()
+	// the transport stops the backend request as soon as the context is done,
+	// so a stuck backend can't hold on to the request past the timeout
+	if options.RequestTimeout > 0 && attempts == 1 {
+		ctx, cancel := context.WithTimeout(r.Context(), options.RequestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	pool := vhosts.Match(r)
+	if pool == nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if pool.JWTRouter != nil && pool.JWTRouter.Match(r) {
+		pool = vhosts.Pool(pool.JWTRouter.Pool)
+	}
+	if scheduled := pool.Router.Match(r).ScheduledPool(time.Now()); scheduled != "" {
+		pool = vhosts.Pool(scheduled)
+	}
+	if pool.Splitter != nil {
+		pool = pool.Splitter.Route(r, pool)
+	}
+	if maintenance, redirect := pool.Maintenance(); maintenance {
+		w.Header().Set("Retry-After", "3600")
+		if redirect != "" {
+			http.Redirect(w, r, redirect, http.StatusFound)
+			return
+		}
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	// the unwrapped request is routed by its own path
+	route := pool.Router.Match(r)
+	if route.UnwrapRequest != nil && attempts == 1 {
+		unwrapped, err := route.UnwrapRequest(r)
+		if err != nil {
+			log.Printf("%s(%s) could not unwrap request: %s\n", clientIP(r), r.URL.Path, err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		r = unwrapped
+		route = pool.Router.Match(r)
+	}
+	if len(route.RetryOnBodyContains) > 0 && attempts == 1 {
+		if err := bufferRequestBody(r); err != nil {
+			log.Printf("%s(%s) could not read request body: %s\n", clientIP(r), r.URL.Path, err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// retries come back through loadBalance, only the first pass is counted
+	if route.breaker != nil && GetAttemptsFromContext(r) == 1 {
+		if !route.breaker.Allow() {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() { route.breaker.Record(sw.status >= http.StatusInternalServerError) }()
+		w = sw
+	}
+
+	if isFanOut(route, r) {
+		fanOut(w, r, pool)
+		return
+	}
+
+	if options.HedgeDelay > 0 && isHedgeable(r) {
+		hedge(w, r, pool)
+		return
+	}
+
+	server := pool.SelectServer()
 	if server != nil {
-		server.ReverseProxy.ServeHTTP(w, r)
+		serve(w, r, pool, server)
 		return
 	}
 
 	http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 }
 
+// serve proxies the request to the given server of the pool
+func serve(w http.ResponseWriter, r *http.Request, pool *ServerPool, server *Server) {
+	ctx := context.WithValue(r.Context(), RequestStart, time.Now())
+	ctx = context.WithValue(ctx, RouteKey, pool.Router.Match(r))
+	if server.queue != nil {
+		serveQueued(w, r.WithContext(ctx), server)
+		return
+	}
+	server.forward(w, r.WithContext(ctx))
+}
+
 func main() {
 	var serverList string
 	var port uint
+	var configPath string
+	var adminPort uint
+	var stateDB string
+	var adminSocket string
+	var corsOrigins string
+	var redisAddr string
+	var redisFailureTTL time.Duration
 	flag.StringVar(&serverList, "servers", "", "Backends attached to the load balancer, use commas to separate")
 	flag.UintVar(&port, "port", PORT, "Serving port")
+	flag.StringVar(&configPath, "config", "", "Path to a YAML config file")
+	flag.StringVar(&options.Strategy, "strategy", "", "Backend selection strategy: round-robin, random, weighted-random, latency-aware or least-connections")
+	flag.DurationVar(&options.Transport.KeepAlive, "backend-tcp-keepalive-interval", 30*time.Second, "Interval between TCP keepalive probes to backends, 0 uses the OS default")
+	flag.IntVar(&options.KeepAliveCount, "backend-tcp-keepalive-count", 9, "Unanswered TCP keepalive probes before a backend connection is dropped (Linux only)")
+	flag.Float64Var(&options.LatencyEpsilon, "latency-epsilon", 0.05, "Share of requests sent to a random backend by the latency-aware strategy")
+	flag.UintVar(&adminPort, "admin-port", 0, "Port of the admin API, 0 disables it")
+	flag.BoolVar(&options.UpstreamHTTP2, "upstream-http2", false, "Use HTTP/2 to all backends, h2c for http:// ones")
+	flag.BoolVar(&options.BackendH2, "backend-h2", false, "Multiplex requests over HTTP/2 to https:// backends that negotiate h2, HTTP/1.1 otherwise")
+	flag.BoolVar(&options.Transport.InsecureSkipVerify, "tls-insecure-skip-verify", false, "Skip verification of backend TLS certificates, for testing only")
+	flag.DurationVar(&options.Transport.IdleConnTimeout, "backend-idle-timeout", 90*time.Second, "Close backend connections idle for longer, before a firewall drops them")
+	flag.BoolVar(&options.Transport.CheckOCSP, "check-backend-ocsp", false, "Refuse backend TLS certificates reported revoked by their OCSP responder")
+	flag.DurationVar(&options.HedgeDelay, "hedge-delay", 0, "Send GET and HEAD requests to a second backend when the first has not answered after this long, 0 disables hedging")
+	flag.BoolVar(&options.HedgePreferSuccess, "hedge-prefer-success", false, "Prefer a later successful hedged response over an earlier 5xx one")
+	flag.DurationVar(&options.HedgeResponseWait, "hedge-response-wait", 100*time.Millisecond, "How long to wait for the other hedged response after a 5xx")
+	flag.DurationVar(&options.RequestTimeout, "request-timeout", 0, "Give up on a request after this long, 0 disables the timeout")
+	flag.Int64Var(&options.MaxNewConnsPerSec, "max-new-conns-per-sec", 0, "Reset connections from clients opening more new connections per second, 0 disables the limit")
+	flag.StringVar(&stateDB, "state-db", "", "Path to a BoltDB file keeping backend status across restarts")
+	flag.StringVar(&adminSocket, "admin-unix-socket", "", "Also serve the admin API on this Unix socket, e.g. /var/run/toylb-admin.sock")
+	flag.IntVar(&options.MaxPushResources, "max-push-resources", 5, "Most resources pushed for one response by push_links_from_hateoas")
+	flag.StringVar(&corsOrigins, "cors-allow-origins", "", "Origins allowed to make cross-origin requests, use commas to separate or * for any")
+	flag.DurationVar(&options.CORSMaxAge, "cors-max-age", 24*time.Hour, "How long browsers may cache CORS preflight responses")
+	flag.Int64Var(&options.RateLimit, "rate-limit", 0, "Answer with a 429 to clients sending more requests per second, 0 disables the limit")
+	flag.DurationVar(&options.TarpitDelay, "tarpit-delay", 0, "Hold rate-limited requests this long before answering with the 429, 0 answers at once")
+	flag.Int64Var(&options.MaxTarpitted, "max-tarpitted", 100, "Most rate-limited requests held at once by -tarpit-delay, the others are answered at once")
+	flag.IntVar(&options.BackendQueueSize, "backend-queue-size", 0, "Requests queued per backend before a 503 is returned, 0 disables the queue")
+	flag.IntVar(&options.BackendWorkers, "backend-queue-workers", 64, "Requests forwarded at once per backend from its queue")
+	flag.StringVar(&options.RequestIDHeader, "request-id-header", "X-Request-ID", "Header carrying the request ID, kept when sent by the client")
+	flag.Int64Var(&options.TruncateResponseBody, "truncate-response-body", 0, "Cut response bodies longer than this many bytes, 0 disables it")
+	flag.Float64Var(&options.MaxRetryFactor, "max-retry-factor", 2, "Most retries per request received within a second across all requests, 0 disables the limit")
+	flag.IntVar(&options.MaxHops, "max-hops", 10, "Answer with a 508 to requests that went through more load balancers, to stop proxy loops")
+	flag.BoolVar(&options.AutoWeight, "auto-weight", false, "Lower the weights of backends slower than the others every minute, by their P99 latency")
+	flag.StringVar(&options.AdminToken, "admin-token", os.Getenv("TOYLB_ADMIN_TOKEN"), "Token backend profiling requests to the admin API must send as a bearer Authorization header, defaults to $TOYLB_ADMIN_TOKEN")
+	flag.BoolVar(&options.BackendPipelining, "backend-pipelining", false, "Pipeline GET, HEAD and OPTIONS requests without a body to each backend on a single HTTP/1.1 connection")
+	flag.IntVar(&options.PipelineDepth, "backend-pipeline-depth", 8, "Most requests awaiting their response on a pipelined backend connection")
+	flag.BoolVar(&options.FollowRedirects, "follow-redirects", false, "Follow redirects of backends to themselves instead of passing them to the client")
+	flag.IntVar(&options.MaxRedirects, "max-redirects", 5, "Most redirects followed for one request with -follow-redirects")
+	flag.StringVar(&options.OPAEndpoint, "opa-endpoint", "", "Open Policy Agent asked whether to allow each request, e.g. http://localhost:8181")
+	flag.DurationVar(&options.OPACacheTTL, "opa-cache-ttl", 5*time.Second, "How long OPA decisions are reused for requests with the same input, 0 disables the cache")
+	flag.DurationVar(&options.OPATimeout, "opa-timeout", 50*time.Millisecond, "Requests are refused when OPA takes longer to decide")
+	flag.BoolVar(&options.TCPMode, "tcp", false, "Forward raw TCP connections to the default pool instead of HTTP requests")
+	flag.BoolVar(&options.EmitProxyProtocol, "emit-proxy-protocol", false, "In TCP mode, send a PROXY protocol v2 header with the client address to backends")
+	flag.BoolVar(&options.AcceptProxyProtocol, "accept-proxy-protocol", false, "In TCP mode, read the client address from a PROXY protocol v2 header sent by clients")
+	flag.StringVar(&redisAddr, "redis-addr", "", "Optional Redis server used to share backend failures between LB instances")
+	flag.DurationVar(&redisFailureTTL, "redis-failure-ttl", 30*time.Second, "How long a backend failure shared over Redis lowers the backend weight")
 	flag.Parse()
 
-	if len(serverList) == 0 {
+	if corsOrigins != "" {
+		options.CORSAllowOrigins = strings.Split(corsOrigins, ",")
+	}
+
+	config := DefaultConfig()
+	if configPath != "" {
+		var err error
+		if config, err = LoadConfig(configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(serverList) > 0 {
+		for _, token := range strings.Split(serverList, ",") {
+			config.Backends = append(config.Backends, BackendConfig{URL: token})
+		}
+	}
+
+	if len(config.Backends) == 0 && len(config.VirtualHosts) == 0 {
 		log.Fatal("At least one instance needed for the LB")
 		panic(-1)
 	}
 
-	serverTokens := strings.Split(serverList, ",")
+	// the flags take precedence over the config file
+	if options.Strategy != "" {
+		config.Strategy = options.Strategy
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "backend-tcp-keepalive-interval":
+			config.Transport.KeepAlive = options.Transport.KeepAlive
+		case "tls-insecure-skip-verify":
+			config.Transport.InsecureSkipVerify = options.Transport.InsecureSkipVerify
+		case "check-backend-ocsp":
+			config.Transport.CheckOCSP = options.Transport.CheckOCSP
+		case "backend-idle-timeout":
+			config.Transport.IdleConnTimeout = options.Transport.IdleConnTimeout
+		}
+	})
+	options.Transport = config.Transport
 
-	// parse servers
-	for _, token := range serverTokens {
-		serverUrl, err := url.Parse(token)
+	if options.MaxRetryFactor > 0 {
+		retryLimiter = NewRetryLimiter(options.MaxRetryFactor)
+	}
+
+	if options.RateLimit > 0 {
+		rateLimiter = NewRateLimiter(options.RateLimit)
+	}
+
+	if options.OPAEndpoint != "" {
+		opaAuthorizer = NewOPAAuthorizer(options.OPAEndpoint, options.OPACacheTTL, options.OPATimeout)
+	}
 
+	if stateDB != "" {
+		store, err := OpenStateStore(stateDB)
 		if err != nil {
 			log.Fatal(err)
 		}
+		stateStore = store
+	}
 
-		// initialize reverse proxy
-		reverseProxy := httputil.NewSingleHostReverseProxy(serverUrl)
-
-		reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
-			log.Printf("[%s] %s\n", serverUrl.Host, e.Error())
-			retries := GetRetriesFromContext(r)
+	// the top-level backends form the default pool, used when no virtual host matches
+	if len(config.Backends) > 0 {
+		pool, err := newServerPool("default", config.PoolConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverPool = pool
+	}
 
-			if retries < MAX_RETRIES {
-				select {
-				case <-time.After(10 * time.Millisecond):
-					ctx := context.WithValue(r.Context(), Retry, retries+1)
-					reverseProxy.ServeHTTP(w, r.WithContext(ctx))
+	vhosts = NewVHostRouter(serverPool)
+	for _, vhost := range config.VirtualHosts {
+		pool, err := newServerPool(vhost.Host, vhost.PoolConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		vhosts.AddHost(vhost.Host, pool)
+	}
+	for _, named := range config.Pools {
+		pool, err := newServerPool(named.Name, named.PoolConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		vhosts.AddPool(pool)
+	}
+	for _, pool := range vhosts.Pools() {
+		if pool.JWTRouter != nil && vhosts.Pool(pool.JWTRouter.Pool) == nil {
+			log.Fatalf("[%s] jwt_claim_route: unknown pool %s", pool.Name, pool.JWTRouter.Pool)
+		}
+		if pool.Splitter != nil {
+			if replicas := vhosts.Pool(pool.Splitter.ReplicaPool); replicas == nil || replicas.Type != Replica {
+				log.Fatalf("[%s] read_write_split: %s is not a replica pool", pool.Name, pool.Splitter.ReplicaPool)
+			}
+		}
+		for _, route := range pool.Router.Routes() {
+			for _, window := range route.schedule {
+				if vhosts.Pool(window.pool) == nil {
+					log.Fatalf("[%s] schedule of %s: unknown pool %s", pool.Name, route.Path, window.pool)
 				}
-				return
 			}
-
-			// after 3 retries, set server status as down
-			serverPool.SetServerStatus(serverUrl, false)
-
-			attempts := GetAttemptsFromContext(r)
-			log.Printf("%s(%s) Attempting retry %d\n", r.RemoteAddr, r.URL.Path, attempts)
-			ctx := context.WithValue(r.Context(), Attempts, attempts+1)
-			loadBalance(w, r.WithContext(ctx))
 		}
+	}
 
-		// add server to ServerPool
-		serverPool.AddServer(&Server{URL: serverUrl, Alive: true, ReverseProxy: reverseProxy})
-		log.Printf("Configured instance: %s\n", serverUrl)
+	// the probes are answered by the LB itself and never reach a backend. A
+	// ServeMux would clean the paths of proxied requests, so match them here.
+	readyz := readyzHandler(vhosts)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			healthzHandler(w, r)
+		case "/readyz":
+			readyz(w, r)
+		default:
+			loadBalance(w, r)
+		}
 	}
 
 	// create http server
-	server := http.Server{
+	lb := http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
-		Handler: http.HandlerFunc(loadBalance),
+		Handler: http.HandlerFunc(handler),
 	}
 
 	// start health checks
-	go serverPool.HealthCheck()
+	for _, pool := range vhosts.Pools() {
+		go pool.HealthCheck()
+		if options.AutoWeight {
+			go pool.AutoWeight()
+		}
+	}
 
-	log.Printf("Load Balancer started at :%d\n", port)
-	if err := server.ListenAndServe(); err != nil {
+	admin := http.Server{
+		Addr:    fmt.Sprintf(":%d", adminPort),
+		Handler: newAdminHandler(vhosts),
+	}
+	if adminPort > 0 {
+		go func() {
+			log.Printf("Admin API started at :%d\n", adminPort)
+			if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if adminSocket != "" {
+		socket, err := listenUnixSocket(adminSocket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(adminSocket)
+
+		go func() {
+			log.Printf("Admin API started at %s\n", adminSocket)
+			if err := admin.Serve(socket); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	listener, err := net.Listen("tcp", lb.Addr)
+	if err != nil {
 		log.Fatal(err)
 	}
+	if options.MaxNewConnsPerSec > 0 {
+		listener = newConnLimitListener(listener, options.MaxNewConnsPerSec)
+	}
+
+	var tcpProxy *TCPProxy
+	if options.TCPMode {
+		if serverPool == nil {
+			log.Fatal("TCP mode needs top-level backends")
+		}
+		tcpProxy = NewTCPProxy(serverPool, listener)
+		go func() {
+			log.Printf("TCP Load Balancer started at :%d\n", port)
+			if err := tcpProxy.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}()
+	} else {
+		go func() {
+			log.Printf("Load Balancer started at :%d\n", port)
+			if err := lb.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// shut down gracefully on SIGINT/SIGTERM, letting in-flight requests finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	if redisAddr != "" {
+		coordinator := NewCoordinator(redisAddr, vhosts, redisFailureTTL)
+		defer coordinator.Close()
+		go coordinator.Run(ctx)
+		log.Printf("Sharing backend failures over redis at %s\n", redisAddr)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			rotateRequestLogs(vhosts)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+
+	log.Println("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if tcpProxy != nil {
+		if err := tcpProxy.Shutdown(ctx); err != nil {
+			log.Println("Shutdown error: ", err)
+		}
+	} else if err := lb.Shutdown(ctx); err != nil {
+		log.Println("Shutdown error: ", err)
+	}
+	admin.Shutdown(ctx)
+
+	if stateStore != nil {
+		if err := stateStore.Close(); err != nil {
+			log.Println("Could not close state db: ", err)
+		}
+	}
 }
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+// setOptions replaces the options for the test, starting from the flag
+// defaults, and puts the previous ones back when it ends
+func setOptions(t *testing.T, change func(o *Options)) {
+	t.Helper()
+
+	previous := options
+	t.Cleanup(func() { options = previous })
+
+	options = Options{
+		Transport:       DefaultTransportConfig(),
+		RequestIDHeader: "X-Request-ID",
+		MaxHops:         10,
+		MaxRedirects:    5,
+		PipelineDepth:   8,
+	}
+	if change != nil {
+		change(&options)
+	}
+}
+
+// setPool makes pool the default pool for the test
+func setPool(t *testing.T, pool *ServerPool) {
+	t.Helper()
+
+	previous, previousHosts := serverPool, vhosts
+	t.Cleanup(func() { serverPool, vhosts = previous, previousHosts })
+
+	serverPool = pool
+	vhosts = NewVHostRouter(pool)
+}
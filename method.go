@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const ORIGINAL_METHOD_HEADER = "X-Original-Method"
+
+// RewriteMethod sends the request with the method given by MethodRewrite, for
+// backends that only support GET and POST. The original method is kept in
+// X-Original-Method, and in a _method query parameter with MethodOverrideParam.
+func (route *Route) RewriteMethod(req *http.Request) {
+	method, ok := route.methodRewrite[req.Method]
+	if !ok || method == req.Method {
+		return
+	}
+
+	req.Header.Set(ORIGINAL_METHOD_HEADER, req.Method)
+	if route.MethodOverrideParam {
+		query := req.URL.Query()
+		query.Set("_method", req.Method)
+		req.URL.RawQuery = query.Encode()
+	}
+	req.Method = method
+}
+
+// newMethodRewrite upper-cases the methods of a MethodRewrite map
+func newMethodRewrite(rewrite map[string]string) map[string]string {
+	methods := make(map[string]string, len(rewrite))
+	for from, to := range rewrite {
+		methods[strings.ToUpper(from)] = strings.ToUpper(to)
+	}
+	return methods
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// global totals, updated atomically
+var (
+	requestsTotal     uint64
+	requestsCancelled uint64
+	// comparing its rate to toylb_requests_total shows how well browsers cache preflights
+	preflightRequests   uint64
+	requestsRateLimited uint64
+	requestsDenied      uint64
+)
+
+var counters = []struct {
+	name  string
+	help  string
+	value *uint64
+}{
+	{"toylb_requests_total", "Requests received, the health probes excluded.", &requestsTotal},
+	{"toylb_cors_preflight_requests_total", "CORS preflight requests answered by the LB.", &preflightRequests},
+	{"toylb_requests_rate_limited_total", "Requests answered with a 429 by the LB.", &requestsRateLimited},
+	{"toylb_requests_denied_total", "Requests answered with a 403 because OPA did not allow them.", &requestsDenied},
+	{"toylb_requests_cancelled_total", "Requests dropped because the client went away before they were proxied.", &requestsCancelled},
+}
+
+// backendGauges are reported for every server of every pool
+var backendGauges = []struct {
+	name  string
+	help  string
+	value func(s *Server) float64
+}{
+	{"toylb_backend_up", "Whether the backend is alive.", func(s *Server) float64 { return boolToFloat(s.IsAlive()) }},
+	{"toylb_backend_active_requests", "Requests being proxied to the backend.", func(s *Server) float64 { return float64(s.GetActiveConns()) }},
+	{"toylb_backend_open_connections", "Connections open to the backend.", func(s *Server) float64 { return float64(s.GetOpenConns()) }},
+	{"toylb_backend_down_seconds", "Seconds since the backend was last seen alive, 0 while it is alive.", func(s *Server) float64 { return s.DownFor().Seconds() }},
+	{"toylb_backend_queue_depth", "Requests waiting in the queue of the backend.", func(s *Server) float64 { return float64(s.QueueDepth()) }},
+	{"toylb_backend_idle_connections", "Open connections to the backend not serving a request.", func(s *Server) float64 { return float64(s.GetIdleConns()) }},
+}
+
+// backendCounters are reported for every server of every pool
+var backendCounters = []struct {
+	name  string
+	help  string
+	value func(s *Server) uint64
+}{
+	{"toylb_slo_violations_total", "Health checks that found the backend P99 latency above slo_p99_ms.", func(s *Server) uint64 { return atomic.LoadUint64(&s.SLOViolations) }},
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// metricsHandler serves GET /metrics in the Prometheus text format
+func metricsHandler(vhosts *VHostRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		for _, counter := range counters {
+			writeMetricHeader(w, counter.name, "counter", counter.help)
+			fmt.Fprintf(w, "%s %d\n", counter.name, atomic.LoadUint64(counter.value))
+		}
+
+		pools := vhosts.Pools()
+		writeMetricHeader(w, "toylb_pool_health_score", "gauge", "Share of live backends in the pool, weighted by capacity for weighted pools.")
+		for _, pool := range pools {
+			fmt.Fprintf(w, "toylb_pool_health_score{pool=%q} %g\n", pool.Name, pool.HealthScore())
+		}
+
+		writeMetricHeader(w, "toylb_pool_in_maintenance", "gauge", "Whether the pool is in maintenance mode.")
+		for _, pool := range pools {
+			maintenance, _ := pool.Maintenance()
+			fmt.Fprintf(w, "toylb_pool_in_maintenance{pool=%q} %g\n", pool.Name, boolToFloat(maintenance))
+		}
+
+		for _, gauge := range backendGauges {
+			writeMetricHeader(w, gauge.name, "gauge", gauge.help)
+			for _, pool := range pools {
+				for _, s := range pool.Servers() {
+					fmt.Fprintf(w, "%s{pool=%q,backend=%q} %g\n", gauge.name, pool.Name, s.URL, gauge.value(s))
+				}
+			}
+		}
+
+		for _, counter := range backendCounters {
+			writeMetricHeader(w, counter.name, "counter", counter.help)
+			for _, pool := range pools {
+				for _, s := range pool.Servers() {
+					fmt.Fprintf(w, "%s{pool=%q,backend=%q} %d\n", counter.name, pool.Name, s.URL, counter.value(s))
+				}
+			}
+		}
+	}
+}
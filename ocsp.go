@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const OCSP_TIMEOUT = 3 * time.Second
+
+// used when a responder does not say how long its answer is valid
+const DEFAULT_OCSP_CACHE_TTL = time.Hour
+
+// ocspCache holds the OCSP status of backend certificates by fingerprint
+var ocspCache sync.Map
+
+type ocspEntry struct {
+	revoked bool
+	until   time.Time
+}
+
+// verifyOCSP is the VerifyPeerCertificate callback of backend TLS connections
+// with -check-backend-ocsp. It fails the handshake when the OCSP responder of
+// the backend certificate reports it revoked. Certificates without a
+// responder, and responders that can't be reached, are let through.
+func verifyOCSP(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	var cert, issuer *x509.Certificate
+	if len(verifiedChains) > 0 && len(verifiedChains[0]) > 1 {
+		cert, issuer = verifiedChains[0][0], verifiedChains[0][1]
+	} else if len(rawCerts) > 1 {
+		// verification is skipped, trust the chain sent by the backend
+		var err error
+		if cert, err = x509.ParseCertificate(rawCerts[0]); err != nil {
+			return err
+		}
+		if issuer, err = x509.ParseCertificate(rawCerts[1]); err != nil {
+			return err
+		}
+	}
+	if cert == nil || len(cert.OCSPServer) == 0 {
+		return nil
+	}
+
+	key := sha256.Sum256(cert.Raw)
+	if cached, ok := ocspCache.Load(key); ok && time.Now().Before(cached.(ocspEntry).until) {
+		return ocspError(cert, cached.(ocspEntry))
+	}
+
+	entry, err := fetchOCSP(cert, issuer)
+	if err != nil {
+		log.Printf("OCSP check of %s failed, allowing: %s\n", cert.Subject, err)
+		return nil
+	}
+	ocspCache.Store(key, entry)
+	return ocspError(cert, entry)
+}
+
+func ocspError(cert *x509.Certificate, entry ocspEntry) error {
+	if entry.revoked {
+		return fmt.Errorf("backend certificate %s is revoked", cert.Subject)
+	}
+	return nil
+}
+
+// fetchOCSP asks the responder of cert for its status, the response must be
+// signed by issuer
+func fetchOCSP(cert, issuer *x509.Certificate) (ocspEntry, error) {
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return ocspEntry{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), OCSP_TIMEOUT)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, cert.OCSPServer[0], bytes.NewReader(req))
+	if err != nil {
+		return ocspEntry{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return ocspEntry{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ocspEntry{}, fmt.Errorf("responder returned %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return ocspEntry{}, err
+	}
+	res, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return ocspEntry{}, err
+	}
+
+	until := res.NextUpdate
+	if until.IsZero() {
+		until = time.Now().Add(DEFAULT_OCSP_CACHE_TTL)
+	}
+	switch res.Status {
+	case ocsp.Good:
+		return ocspEntry{until: until}, nil
+	case ocsp.Revoked:
+		return ocspEntry{revoked: true, until: until}, nil
+	}
+	return ocspEntry{}, errors.New("certificate status unknown")
+}
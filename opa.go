@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// opaAuthorizer is set when -opa-endpoint is given
+var opaAuthorizer *OPAAuthorizer
+
+const OPA_DECISION_PATH = "/v1/data/toylb/allow"
+
+// opaInput is the request metadata the policy decides on
+type opaInput struct {
+	Method   string                 `json:"method"`
+	Path     string                 `json:"path"`
+	Headers  map[string]string      `json:"headers"`
+	RemoteIP string                 `json:"remote_ip"`
+	Claims   map[string]interface{} `json:"claims,omitempty"`
+}
+
+type opaDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+// OPAAuthorizer asks an Open Policy Agent whether requests are allowed.
+// Decisions are cached by their input for the cache TTL.
+type OPAAuthorizer struct {
+	url      string
+	ttl      time.Duration
+	timeout  time.Duration
+	client   *http.Client
+	decision sync.Map
+}
+
+func NewOPAAuthorizer(endpoint string, ttl, timeout time.Duration) *OPAAuthorizer {
+	a := &OPAAuthorizer{
+		url:     strings.TrimRight(endpoint, "/") + OPA_DECISION_PATH,
+		ttl:     ttl,
+		timeout: timeout,
+		client:  &http.Client{},
+	}
+	go a.cleanup()
+	return a
+}
+
+// Allow reports whether the policy allows the request. Requests are refused
+// when OPA can't be reached in time or gives no decision.
+func (a *OPAAuthorizer) Allow(r *http.Request) bool {
+	input, err := json.Marshal(map[string]opaInput{"input": newOPAInput(r)})
+	if err != nil {
+		log.Printf("ERROR could not encode OPA input: %s\n", err)
+		return false
+	}
+
+	key := string(input)
+	if cached, ok := a.decision.Load(key); ok && time.Now().Before(cached.(opaDecision).expires) {
+		return cached.(opaDecision).allow
+	}
+
+	allow, err := a.query(r.Context(), input)
+	if err != nil {
+		log.Printf("ERROR %s(%s) OPA decision failed: %s\n", clientIP(r), r.URL.Path, err)
+		return false
+	}
+	if a.ttl > 0 {
+		a.decision.Store(key, opaDecision{allow: allow, expires: time.Now().Add(a.ttl)})
+	}
+	return allow
+}
+
+func (a *OPAAuthorizer) query(ctx context.Context, input []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(input))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("OPA answered %s", resp.Status)
+	}
+
+	var body struct {
+		Result *bool `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return false, err
+	}
+	if body.Result == nil {
+		return false, fmt.Errorf("toylb/allow is undefined")
+	}
+	return *body.Result, nil
+}
+
+// cleanup drops expired decisions so the cache doesn't grow with every new input
+func (a *OPAAuthorizer) cleanup() {
+	t := time.NewTicker(time.Minute)
+	for range t.C {
+		now := time.Now()
+		a.decision.Range(func(key, value interface{}) bool {
+			if now.After(value.(opaDecision).expires) {
+				a.decision.Delete(key)
+			}
+			return true
+		})
+	}
+}
+
+func newOPAInput(r *http.Request) opaInput {
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		// unique per request, it would defeat the cache
+		if name == http.CanonicalHeaderKey(options.RequestIDHeader) {
+			continue
+		}
+		headers[name] = strings.Join(values, ", ")
+	}
+
+	claims, _ := jwtClaims(r)
+	return opaInput{Method: r.Method, Path: r.URL.Path, Headers: headers, RemoteIP: clientIP(r), Claims: claims}
+}
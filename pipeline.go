@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// pipelineTransport sends the requests to one backend pipelined on a single
+// HTTP/1.1 keep-alive connection, up to depth of them awaiting their response
+// at once. Responses come back in the order the requests were sent, so a slow
+// response holds up the ones behind it. Only GET, HEAD and OPTIONS requests
+// without a body are pipelined, the others go through base.
+type pipelineTransport struct {
+	base  *http.Transport
+	depth int
+
+	mux  sync.Mutex
+	conn *pipelineConn
+}
+
+type pipelineCall struct {
+	req    *http.Request
+	result chan pipelineResult
+}
+
+type pipelineResult struct {
+	resp *http.Response
+	err  error
+}
+
+// pipelineConn is one connection with the requests sent on it awaiting a response
+type pipelineConn struct {
+	conn    net.Conn
+	writer  *bufio.Writer
+	pending chan *pipelineCall
+
+	once   sync.Once
+	closed chan struct{}
+
+	// guarded by mux
+	mux       sync.Mutex
+	inflight  int
+	idleSince time.Time
+}
+
+func newPipelineTransport(base *http.Transport, depth int) *pipelineTransport {
+	if depth < 1 {
+		depth = 1
+	}
+	return &pipelineTransport{base: base, depth: depth}
+}
+
+// CloseIdleConnections closes the idle connections of base, and the pipelined
+// connection unless requests are awaiting their response on it
+func (t *pipelineTransport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.conn != nil && t.conn.isIdle() {
+		t.conn.close()
+		t.conn = nil
+	}
+}
+
+// isPipelined reports whether the request is idempotent and has no body.
+// Requests are written while holding the connection, so a slow upload would
+// hold up every request behind it.
+func isPipelined(r *http.Request) bool {
+	if r.Body != nil && r.Body != http.NoBody {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+func (t *pipelineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isPipelined(req) || (req.URL.Scheme != "http" && req.URL.Scheme != "https") {
+		return t.base.RoundTrip(req)
+	}
+
+	call := &pipelineCall{req: req, result: make(chan pipelineResult, 1)}
+	if err := t.send(call); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-call.result:
+		return res.resp, res.err
+	case <-req.Context().Done():
+		// the response still has to be read off the connection for the ones behind it
+		go func() {
+			if res := <-call.result; res.resp != nil {
+				res.resp.Body.Close()
+			}
+		}()
+		return nil, req.Context().Err()
+	}
+}
+
+// send writes the request on the connection, dialing one when there is none
+func (t *pipelineTransport) send(call *pipelineCall) error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	// a connection idle for longer than the idle timeout may have been dropped
+	// by the backend or a firewall in between
+	if timeout := t.base.IdleConnTimeout; t.conn != nil && timeout > 0 && t.conn.idleFor() > timeout {
+		t.conn.close()
+	}
+	if t.conn == nil || t.conn.isClosed() {
+		conn, err := t.dial(call.req.Context(), call.req.URL)
+		if err != nil {
+			return err
+		}
+		t.conn = conn
+	}
+
+	conn := t.conn
+	select {
+	case conn.pending <- call:
+		conn.begin()
+	case <-conn.closed:
+		return io.ErrUnexpectedEOF
+	case <-call.req.Context().Done():
+		return call.req.Context().Err()
+	}
+
+	if err := call.req.Write(conn.writer); err != nil {
+		conn.close()
+		return err
+	}
+	if err := conn.writer.Flush(); err != nil {
+		conn.close()
+		return err
+	}
+	return nil
+}
+
+func (t *pipelineTransport) dial(ctx context.Context, u *url.URL) (*pipelineConn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := t.base.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		config := t.base.TLSClientConfig.Clone()
+		config.ServerName = u.Hostname()
+		config.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	pc := &pipelineConn{
+		conn:      conn,
+		writer:    bufio.NewWriter(conn),
+		pending:   make(chan *pipelineCall, t.depth),
+		closed:    make(chan struct{}),
+		idleSince: time.Now(),
+	}
+	go pc.readLoop()
+	return pc, nil
+}
+
+// readLoop reads the responses in the order the requests were sent, each
+// once the body of the previous one has been consumed
+func (pc *pipelineConn) readLoop() {
+	defer pc.close()
+
+	reader := bufio.NewReader(pc.conn)
+	for {
+		var call *pipelineCall
+		select {
+		case call = <-pc.pending:
+		case <-pc.closed:
+			pc.failPending()
+			return
+		}
+
+		resp, err := http.ReadResponse(reader, call.req)
+		if err != nil {
+			call.result <- pipelineResult{err: fmt.Errorf("pipelined response: %w", io.ErrUnexpectedEOF)}
+			pc.close()
+			pc.failPending()
+			return
+		}
+
+		body := &pipelineBody{ReadCloser: resp.Body, done: make(chan struct{}), conn: pc}
+		resp.Body = body
+		call.result <- pipelineResult{resp: resp}
+
+		select {
+		case <-body.done:
+		case <-pc.closed:
+			pc.failPending()
+			return
+		}
+		if resp.Close {
+			pc.close()
+			pc.failPending()
+			return
+		}
+	}
+}
+
+// begin counts a request sent on the connection
+func (pc *pipelineConn) begin() {
+	pc.mux.Lock()
+	pc.inflight++
+	pc.mux.Unlock()
+}
+
+// end counts a response read off the connection
+func (pc *pipelineConn) end() {
+	pc.mux.Lock()
+	defer pc.mux.Unlock()
+
+	pc.inflight--
+	if pc.inflight == 0 {
+		pc.idleSince = time.Now()
+	}
+}
+
+// isIdle reports whether no request is awaiting a response on the connection
+func (pc *pipelineConn) isIdle() bool {
+	pc.mux.Lock()
+	defer pc.mux.Unlock()
+	return pc.inflight == 0
+}
+
+// idleFor returns how long no request has been awaiting a response, 0 while one is
+func (pc *pipelineConn) idleFor() time.Duration {
+	pc.mux.Lock()
+	defer pc.mux.Unlock()
+
+	if pc.inflight > 0 {
+		return 0
+	}
+	return time.Since(pc.idleSince)
+}
+
+func (pc *pipelineConn) failPending() {
+	for {
+		select {
+		case call := <-pc.pending:
+			call.result <- pipelineResult{err: io.ErrUnexpectedEOF}
+		default:
+			return
+		}
+	}
+}
+
+func (pc *pipelineConn) close() {
+	pc.once.Do(func() {
+		close(pc.closed)
+		pc.conn.Close()
+	})
+}
+
+func (pc *pipelineConn) isClosed() bool {
+	select {
+	case <-pc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// pipelineBody lets the read loop move on to the next response once the body
+// is read or closed. Closing drains what is left so the next response starts
+// where it should.
+type pipelineBody struct {
+	io.ReadCloser
+	once sync.Once
+	done chan struct{}
+	conn *pipelineConn
+}
+
+func (b *pipelineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.finish)
+	}
+	return n, err
+}
+
+func (b *pipelineBody) Close() error {
+	io.Copy(io.Discard, b.ReadCloser)
+	err := b.ReadCloser.Close()
+	b.once.Do(b.finish)
+	return err
+}
+
+// finish counts the response as done before the read loop moves on, so the
+// connection is idle as soon as the body is consumed
+func (b *pipelineBody) finish() {
+	b.conn.end()
+	close(b.done)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowBody sends its data only after delay, like a slow client upload
+type slowBody struct {
+	io.Reader
+	delay time.Duration
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	time.Sleep(b.delay)
+	b.delay = 0
+	return b.Reader.Read(p)
+}
+
+func TestPipelineSlowUploadDoesNotBlock(t *testing.T) {
+	setOptions(t, func(o *Options) { o.BackendPipelining = true })
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, r.Method)
+	}))
+	defer backend.Close()
+
+	server, err := newServer(BackendConfig{URL: backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploaded := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/", &slowBody{Reader: strings.NewReader("data"), delay: time.Second})
+		server.ReverseProxy.ServeHTTP(w, r)
+		uploaded <- w.Code
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	server.ReverseProxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != http.MethodGet {
+		t.Fatalf("got %d %q, want 200 GET", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("GET took %s behind a slow PUT upload, want it not held up", elapsed)
+	}
+
+	if code := <-uploaded; code != http.StatusOK {
+		t.Errorf("PUT got %d, want 200", code)
+	}
+}
@@ -1,69 +1,371 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
-	"net/url"
+	"math/rand"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+const DEFAULT_HEALTH_CHECK_INTERVAL = 20 * time.Second
+
 type ServerPool struct {
-	servers []*Server
-	current uint64
+	Name                string
+	Router              *Router
+	Mode                PoolMode
+	Type                PoolType
+	HealthCheckInterval time.Duration
+	// 0 uses half the interval so a check never overlaps the next tick
+	HealthCheckTimeout time.Duration
+	// a pool_degraded event fires when HealthScore drops below this, 0 disables it
+	HealthScoreThreshold float64
+	// nil when the pool has no jwt_claim_route
+	JWTRouter *JWTClaimRouter
+	// nil when the pool has no read_write_split
+	Splitter *ReadWriteSplitter
+
+	degraded bool
+
+	// guarded by mux
+	maintenance         bool
+	maintenanceRedirect string
+
+	servers  []*Server
+	current  uint64
+	strategy SelectionStrategy
+	// share of random picks made by the latency-aware strategy
+	latencyEpsilon float64
+
+	mux sync.RWMutex
 }
 
 func (p *ServerPool) AddServer(server *Server) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
 	p.servers = append(p.servers, server)
+	server.StartGracePeriod()
+}
+
+func (p *ServerPool) SetStrategy(strategy SelectionStrategy) {
+	p.strategy = strategy
+}
+
+func (p *ServerPool) SetLatencyEpsilon(epsilon float64) {
+	p.latencyEpsilon = epsilon
+}
+
+// SelectServer picks a server according to the pool mode and strategy
+func (p *ServerPool) SelectServer() *Server {
+	if p.Mode == HotStandby {
+		return p.PrimaryServer()
+	}
+
+	switch p.strategy {
+	case Random:
+		return p.RandomServer()
+	case WeightedRandom:
+		return p.WeightedRandomServer()
+	case LatencyAware:
+		return p.LatencyAwareServer()
+	case LeastConnections:
+		return p.LeastConnections()
+	default:
+		return p.NextServer()
+	}
+}
+
+// aliveTiers groups the servers that may receive requests by Priority
+func (p *ServerPool) aliveTiers() map[int][]*Server {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	tiers := make(map[int][]*Server)
+	for _, s := range p.servers {
+		if s.IsAvailable() {
+			tiers[s.Priority] = append(tiers[s.Priority], s)
+		}
+	}
+	return tiers
+}
+
+// candidates returns the available servers of the most preferred (lowest)
+// priority tier. When every server of a tier is down the next tier takes over.
+func (p *ServerPool) candidates() []*Server {
+	var best []*Server
+	bestPriority := 0
+	for priority, servers := range p.aliveTiers() {
+		if best == nil || priority < bestPriority {
+			best, bestPriority = servers, priority
+		}
+	}
+	return best
 }
 
-func (p *ServerPool) AliveServerIndex() int {
-	return int(atomic.AddUint64(&p.current, uint64(1)) % uint64(len(p.servers)))
+// unpenalized returns the servers without a weight penalty, or all of them
+// when each has one. Strategies that don't use weights skip penalized servers
+// instead of lowering their share.
+func unpenalized(servers []*Server) []*Server {
+	var kept []*Server
+	for _, s := range servers {
+		if !s.IsPenalized() {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == 0 {
+		return servers
+	}
+	return kept
+}
+
+// PrimaryServer returns the first alive server, used in hot-standby mode. When
+// it goes down the next one in line takes over.
+func (p *ServerPool) PrimaryServer() *Server {
+	candidates := p.candidates()
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[0]
+}
+
+// PromoteStandby moves the current primary to the end of the line so that the
+// next standby server becomes primary
+func (p *ServerPool) PromoteStandby() *Server {
+	primary := p.PrimaryServer()
+	if primary == nil {
+		return nil
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for i, s := range p.servers {
+		if s == primary {
+			p.servers = append(append(p.servers[:i:i], p.servers[i+1:]...), primary)
+			break
+		}
+	}
+	return primary
 }
 
 // get the Next alive server
 func (p *ServerPool) NextServer() *Server {
-	nextIndex := int(atomic.AddUint64(&p.current, uint64(1)))
-	l := len(p.servers) + nextIndex
-
-	for i := nextIndex; i < l; i++ {
-		next := i % len(p.servers)
-		if p.servers[next].IsAlive() {
-			if i != nextIndex {
-				atomic.StoreUint64(&p.current, uint64(next))
-			}
-			return p.servers[next]
+	candidates := unpenalized(p.candidates())
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	next := atomic.AddUint64(&p.current, uint64(1))
+	return candidates[next%uint64(len(candidates))]
+}
+
+// RandomServer picks one of the alive servers uniformly at random
+func (p *ServerPool) RandomServer() *Server {
+	alive := unpenalized(p.candidates())
+	if len(alive) == 0 {
+		return nil
+	}
+	return alive[rand.Intn(len(alive))]
+}
+
+// weightedIntn draws the numbers of WeightedRandomServer, tests give it a fixed seed
+var weightedIntn = rand.Intn
+
+// WeightedRandomServer picks an alive server with probability proportional to its Weight.
+// The CDF is built per call so no state is shared between goroutines.
+func (p *ServerPool) WeightedRandomServer() *Server {
+	candidates := p.candidates()
+	alive := make([]*Server, 0, len(candidates))
+	cdf := make([]int, 0, len(candidates))
+	total := 0
+	for _, s := range candidates {
+		if weight := s.GetWeight(); weight > 0 {
+			total += weight
+			alive = append(alive, s)
+			cdf = append(cdf, total)
 		}
 	}
-	return nil
+
+	if total == 0 {
+		return nil
+	}
+
+	n := weightedIntn(total)
+	return alive[sort.SearchInts(cdf, n+1)]
+}
+
+// LatencyAwareServer returns the alive server with the lowest LatencyEWMA.
+// A small share of requests goes to a random server instead so that traffic
+// does not pile onto one backend when latencies are nearly equal.
+func (p *ServerPool) LatencyAwareServer() *Server {
+	if rand.Float64() < p.latencyEpsilon {
+		return p.RandomServer()
+	}
+
+	var best *Server
+	bestLatency := 0.0
+	for _, s := range unpenalized(p.candidates()) {
+		latency := s.GetLatencyEWMA()
+		if best == nil || latency < bestLatency {
+			best, bestLatency = s, latency
+		}
+	}
+	return best
+}
+
+// LeastConnections returns the available server with the fewest requests in flight
+func (p *ServerPool) LeastConnections() *Server {
+	var best *Server
+	var bestConns int64
+	for _, s := range unpenalized(p.candidates()) {
+		conns := s.GetActiveConns()
+		if best == nil || conns < bestConns {
+			best, bestConns = s, conns
+		}
+	}
+	return best
+}
+
+// AliveCount returns how many servers may receive requests
+func (p *ServerPool) AliveCount() int {
+	count := 0
+	for _, servers := range p.aliveTiers() {
+		count += len(servers)
+	}
+	return count
+}
+
+// HealthScore returns the share of servers that are alive, from 0.0 to 1.0.
+// With the weighted-random strategy servers count by their Weight.
+func (p *ServerPool) HealthScore() float64 {
+	total, alive := 0, 0
+	for _, s := range p.Servers() {
+		capacity := 1
+		if p.strategy == WeightedRandom {
+			capacity = s.BaseWeight()
+		}
+
+		total += capacity
+		if s.IsAlive() {
+			alive += capacity
+		}
+	}
+
+	if total == 0 {
+		return 0
+	}
+	return float64(alive) / float64(total)
+}
+
+// checkHealthScore publishes pool_degraded once the score drops below the
+// threshold, and pool_recovered once it is back above it
+func (p *ServerPool) checkHealthScore() {
+	if p.HealthScoreThreshold <= 0 {
+		return
+	}
+
+	score := p.HealthScore()
+	switch {
+	case score < p.HealthScoreThreshold && !p.degraded:
+		p.degraded = true
+		log.Printf("ERROR [%s] pool degraded, health score %.2f below %.2f\n", p.Name, score, p.HealthScoreThreshold)
+		events.Publish(Event{Type: "pool_degraded", Pool: p.Name, Message: fmt.Sprintf("health score %.2f", score)})
+	case score >= p.HealthScoreThreshold && p.degraded:
+		p.degraded = false
+		log.Printf("[%s] pool recovered, health score %.2f\n", p.Name, score)
+		events.Publish(Event{Type: "pool_recovered", Pool: p.Name, Message: fmt.Sprintf("health score %.2f", score)})
+	}
 }
 
-// SetServerStatus changes a status of a server
-func (p *ServerPool) SetServerStatus(url *url.URL, alive bool) {
+// SetMaintenance turns the maintenance mode of the pool on or off. While it is
+// on requests get a 503, or are redirected to redirect when it is not empty.
+func (p *ServerPool) SetMaintenance(enabled bool, redirect string) {
+	p.mux.Lock()
+	changed := enabled != p.maintenance
+	p.maintenance = enabled
+	p.maintenanceRedirect = redirect
+	p.mux.Unlock()
+
+	if changed && enabled {
+		log.Printf("[%s] maintenance mode enabled\n", p.Name)
+	} else if changed {
+		log.Printf("[%s] maintenance mode disabled\n", p.Name)
+	}
+}
+
+// Maintenance returns whether the pool is in maintenance mode and where requests are redirected
+func (p *ServerPool) Maintenance() (bool, string) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	return p.maintenance, p.maintenanceRedirect
+}
+
+// Servers returns a snapshot of the servers in the pool
+func (p *ServerPool) Servers() []*Server {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	return append([]*Server(nil), p.servers...)
+}
+
+// GetServer finds a server by its URL
+func (p *ServerPool) GetServer(rawurl string) *Server {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
 	for _, s := range p.servers {
-		if s.URL.String() == url.String() {
-			s.Alive = alive
-			break
+		if s.URL.String() == rawurl {
+			return s
 		}
 	}
+	return nil
 }
 
 func (p *ServerPool) HealthCheck() {
-	t := time.NewTicker(time.Second * 20)
+	interval := p.HealthCheckInterval
+	if interval <= 0 {
+		interval = DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+
+	timeout := p.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = interval / 2
+	}
+
+	t := time.NewTicker(interval)
 	for {
 		select {
 		case <-t.C:
-			log.Println("Starting Health Check....")
-
-			for _, s := range p.servers {
-				alive := isServerAlive(s.URL)
-				s.SetAlive(alive)
-				if alive {
-					log.Printf("%s [%s]\n", s.URL, "UP")
-				} else {
-					log.Printf("%s [%s]\n", s.URL, "DOWN")
-				}
-			}
-			log.Println("Health check done.")
+			p.checkHealth(timeout)
+		}
+	}
+}
+
+// checkHealth runs one health check pass over the servers of the pool
+func (p *ServerPool) checkHealth(timeout time.Duration) {
+	log.Printf("[%s] Starting Health Check....\n", p.Name)
+
+	for _, s := range p.Servers() {
+		alive := isServerHealthy(context.Background(), s, timeout)
+		// checked on every pass so that the expiry is logged when it happens
+		inGracePeriod := s.InGracePeriod()
+		if !alive && inGracePeriod {
+			log.Printf("%s [%s] ignored during the initial grace period\n", s.URL, "DOWN")
+			continue
+		}
+		s.SetAlive(alive)
+		if alive {
+			log.Printf("%s [%s]\n", s.URL, "UP")
+			s.checkSLO(p.Name)
+		} else {
+			log.Printf("%s [%s]\n", s.URL, "DOWN")
 		}
 	}
+	p.checkHealthScore()
+	log.Printf("[%s] Health check done.\n", p.Name)
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// CHI_SQUARED_CRITICAL is the 0.1% critical value with 2 degrees of freedom
+const CHI_SQUARED_CRITICAL = 13.816
+
+func newWeightedPool(weights ...int) *ServerPool {
+	pool := &ServerPool{Name: "test"}
+	pool.SetStrategy(WeightedRandom)
+	for i, weight := range weights {
+		u := &url.URL{Scheme: "http", Host: "backend-" + string(rune('a'+i))}
+		pool.AddServer(&Server{URL: u, Alive: true, Weight: weight})
+	}
+	return pool
+}
+
+// smoothWeightedRoundRobin is the nginx algorithm, the stateful baseline
+// weighted random selection is compared with
+type smoothWeightedRoundRobin struct {
+	servers []*Server
+	current []int
+}
+
+func (s *smoothWeightedRoundRobin) next() *Server {
+	total, best := 0, 0
+	for i, server := range s.servers {
+		s.current[i] += server.Weight
+		total += server.Weight
+		if s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	s.current[best] -= total
+	return s.servers[best]
+}
+
+// chiSquared measures how far the picks of each server are from their share of the weight
+func chiSquared(servers []*Server, picks map[*Server]int, n int) float64 {
+	total := 0
+	for _, s := range servers {
+		total += s.Weight
+	}
+
+	chi := 0.0
+	for _, s := range servers {
+		expected := float64(n) * float64(s.Weight) / float64(total)
+		diff := float64(picks[s]) - expected
+		chi += diff * diff / expected
+	}
+	return chi
+}
+
+func TestWeightedRandomServerFairness(t *testing.T) {
+	weightedIntn = rand.New(rand.NewSource(1)).Intn
+	t.Cleanup(func() { weightedIntn = rand.Intn })
+
+	const n = 60000
+	pool := newWeightedPool(5, 3, 1)
+	servers := pool.Servers()
+
+	random := make(map[*Server]int)
+	for i := 0; i < n; i++ {
+		random[pool.SelectServer()]++
+	}
+
+	swrr := &smoothWeightedRoundRobin{servers: servers, current: make([]int, len(servers))}
+	roundRobin := make(map[*Server]int)
+	for i := 0; i < n; i++ {
+		roundRobin[swrr.next()]++
+	}
+
+	randomChi := chiSquared(servers, random, n)
+	roundRobinChi := chiSquared(servers, roundRobin, n)
+	t.Logf("chi-squared over %d picks: weighted random %.3f, smooth weighted round-robin %.3f", n, randomChi, roundRobinChi)
+
+	if randomChi > CHI_SQUARED_CRITICAL {
+		t.Errorf("weighted random picks %v don't follow the weights 5:3:1, chi-squared %.3f > %.3f", random, randomChi, CHI_SQUARED_CRITICAL)
+	}
+	// round-robin is exact over whole cycles, random only converges to it
+	if roundRobinChi > randomChi {
+		t.Errorf("smooth weighted round-robin chi-squared %.3f above weighted random %.3f", roundRobinChi, randomChi)
+	}
+}
+
+func TestWeightedRandomServerSkipsDown(t *testing.T) {
+	pool := newWeightedPool(1, 100)
+	pool.Servers()[1].SetAlive(false)
+
+	for i := 0; i < 100; i++ {
+		if s := pool.SelectServer(); s != pool.Servers()[0] {
+			t.Fatalf("picked %v, want the only alive server", s.URL)
+		}
+	}
+}
+
+func TestGracePeriodExpiresWhileHealthy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	pool, err := newServerPool("default", PoolConfig{Backends: []BackendConfig{{URL: backend.URL, InitialGracePeriod: 50 * time.Millisecond}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	pool.checkHealth(time.Second)
+	if strings.Contains(logs.String(), "grace period expired") {
+		t.Fatal("grace period expired too early")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	pool.checkHealth(time.Second)
+	if !strings.Contains(logs.String(), "grace period expired") {
+		t.Error("expiry of the grace period not logged by the health check of an alive server")
+	}
+	if pool.Servers()[0].InGracePeriod() {
+		t.Error("server still in its grace period")
+	}
+}
+
+func TestStrategiesSkipPenalizedServers(t *testing.T) {
+	for _, strategy := range []SelectionStrategy{RoundRobin, Random, LatencyAware, LeastConnections} {
+		t.Run(strategy.String(), func(t *testing.T) {
+			pool := newWeightedPool(1, 1, 1)
+			pool.SetStrategy(strategy)
+			servers := pool.Servers()
+			servers[0].PenalizeWeight(time.Minute)
+
+			for i := 0; i < 100; i++ {
+				if s := pool.SelectServer(); s == servers[0] {
+					t.Fatalf("pick %d went to the penalized server", i)
+				}
+			}
+
+			servers[1].PenalizeWeight(time.Minute)
+			servers[2].PenalizeWeight(time.Minute)
+			if s := pool.SelectServer(); s == nil {
+				t.Error("no server picked with every server penalized")
+			}
+		})
+	}
+}
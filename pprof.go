@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// profiles served by net/http/pprof that may be fetched from backends
+var pprofProfiles = map[string]bool{
+	"allocs":       true,
+	"block":        true,
+	"cmdline":      true,
+	"goroutine":    true,
+	"heap":         true,
+	"mutex":        true,
+	"profile":      true,
+	"symbol":       true,
+	"threadcreate": true,
+	"trace":        true,
+}
+
+// pprofHandler serves GET /admin/backends/{url}/pprof/{profile}, streaming
+// /debug/pprof/{profile} of the backend so its pprof endpoints need not be
+// reachable from the network. The backend URL is path escaped. It is only
+// enabled with -admin-token.
+func pprofHandler(vhosts *VHostRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if options.AdminToken == "" {
+			http.Error(w, "Profiling requires -admin-token", http.StatusForbidden)
+			return
+		}
+
+		_, server := findServer(vhosts, r.PathValue("url"))
+		if server == nil {
+			http.Error(w, "Unknown server", http.StatusNotFound)
+			return
+		}
+		profile := r.PathValue("profile")
+		if !pprofProfiles[profile] {
+			http.Error(w, "Unknown profile", http.StatusNotFound)
+			return
+		}
+
+		target := server.URL.JoinPath("/debug/pprof", profile)
+		target.RawQuery = r.URL.RawQuery
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("%s fetching %s profile of %s\n", r.RemoteAddr, profile, server.URL)
+		client := &http.Client{Transport: server.ReverseProxy.Transport}
+		resp, err := client.Do(req)
+		if err != nil {
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		for _, name := range []string{"Content-Type", "Content-Length"} {
+			if value := resp.Header.Get(name); value != "" {
+				w.Header().Set(name, value)
+			}
+		}
+		if resp.StatusCode == http.StatusOK {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=backend_%s.prof", profile))
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// newServer sets up a backend and the reverse proxy in front of it
+func newServer(backend BackendConfig) (*Server, error) {
+	serverUrl, err := url.Parse(backend.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	weight := backend.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	alpha := backend.EWMAAlpha
+	if alpha <= 0 || alpha > 1 {
+		alpha = DEFAULT_EWMA_ALPHA
+	}
+	useHTTP2 := options.UpstreamHTTP2 || backend.UseHTTP2
+	now := time.Now()
+	server := &Server{URL: serverUrl, Alive: true, Weight: weight, Priority: backend.Priority, EWMAAlpha: alpha, UseHTTP2: useHTTP2, LastSeenAlive: now, LastStatusChange: now}
+	server.SLOP99 = time.Duration(backend.SLOP99Ms) * time.Millisecond
+	server.HealthCheckPath = backend.HealthCheckPath
+	server.HealthCheckJSONPath = backend.HealthCheckJSONPath
+	server.HealthCheckJSONValue = backend.HealthCheckJSONValue
+	server.InitialGracePeriod = backend.InitialGracePeriod
+	if backend.LogFile != "" {
+		if server.requestLog, err = openRequestLog(backend.LogFile); err != nil {
+			return nil, err
+		}
+	}
+	if stateStore != nil {
+		stateStore.Restore(server)
+	}
+
+	// initialize reverse proxy
+	reverseProxy := httputil.NewSingleHostReverseProxy(serverUrl)
+	director := reverseProxy.Director
+	reverseProxy.Director = func(req *http.Request) {
+		director(req)
+		GetRouteFromContext(req).RewriteMethod(req)
+	}
+	transport := newTransport(options.Transport, options.KeepAliveCount, &server.OpenConns)
+	switch {
+	case useHTTP2:
+		reverseProxy.Transport = newHTTP2Transport(serverUrl, transport)
+	case options.BackendH2 && serverUrl.Scheme == "https":
+		if reverseProxy.Transport, err = newMultiplexTransport(transport); err != nil {
+			return nil, err
+		}
+	case options.BackendPipelining:
+		reverseProxy.Transport = newPipelineTransport(transport, options.PipelineDepth)
+	default:
+		reverseProxy.Transport = transport
+	}
+	if options.FollowRedirects {
+		reverseProxy.Transport = &redirectTransport{next: reverseProxy.Transport, max: options.MaxRedirects}
+	}
+
+	reverseProxy.ModifyResponse = func(resp *http.Response) error {
+		if start, ok := resp.Request.Context().Value(RequestStart).(time.Time); ok {
+			server.ObserveLatency(time.Since(start))
+		}
+		route := GetRouteFromContext(resp.Request)
+		if !route.IsNonRetryable(resp.StatusCode) {
+			if err := route.CheckRetryableBody(resp); err != nil {
+				return err
+			}
+		}
+		// the client already has the request ID, a backend echoing it would send it twice
+		resp.Header.Del(options.RequestIDHeader)
+		route.FilterResponseHeaders(resp.Header)
+		rewriteLocation(resp)
+		addCORSHeaders(resp)
+		route.RewriteStatus(resp)
+		route.NormalizeResponseEncoding(resp)
+		route.PushLinks(resp)
+		route.LogResponseBodyFields(resp)
+		route.RenderBody(resp)
+		truncateBody(resp)
+		return nil
+	}
+
+	reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
+		log.Printf("[%s] %s\n", serverUrl.Host, e.Error())
+		if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+			log.Printf("event=request_timeout client=%s path=%s backend=%s\n", clientIP(r), r.URL.Path, serverUrl)
+			http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+			return
+		}
+		// the client went away or a hedged request lost, nobody waits for a retry
+		if isCancelled(r) {
+			return
+		}
+
+		retryableBody := errors.Is(e, errRetryableBody)
+		if !isConnectionError(e) && !retryableBody {
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		if retryableBody && !canReplayBody(r) {
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		r = replayBody(r)
+
+		retries := GetRetriesFromContext(r)
+
+		if retryLimiter != nil {
+			if retries == 0 && GetAttemptsFromContext(r) == 1 && !retryLimiter.Allow() {
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			retryLimiter.Retry()
+		}
+
+		if retries < MAX_RETRIES {
+			handOff(r, func() {
+				select {
+				case <-time.After(10 * time.Millisecond):
+					if isCancelled(r) {
+						return
+					}
+					ctx := context.WithValue(r.Context(), Retry, retries+1)
+					ctx = context.WithValue(ctx, RequestStart, time.Now())
+					if server.queue != nil {
+						serveQueued(w, r.WithContext(ctx), server)
+						return
+					}
+					reverseProxy.ServeHTTP(w, r.WithContext(ctx))
+				}
+			})
+			return
+		}
+
+		// after 3 retries, set server status as down, unless it answers but with an error body
+		if !retryableBody {
+			server.SetAlive(false)
+		}
+
+		attempts := GetAttemptsFromContext(r)
+		log.Printf("%s(%s) Attempting retry %d\n", r.RemoteAddr, r.URL.Path, attempts)
+		ctx := context.WithValue(r.Context(), Attempts, attempts+1)
+		handOff(r, func() { loadBalance(w, r.WithContext(ctx)) })
+	}
+
+	server.ReverseProxy = reverseProxy
+	if options.BackendQueueSize > 0 {
+		server.startQueue(options.BackendQueueSize, options.BackendWorkers)
+	}
+	return server, nil
+}
+
+// newServerPool builds a pool with its servers, strategy and routes
+func newServerPool(name string, config PoolConfig) (*ServerPool, error) {
+	strategy, err := ParseStrategy(config.Strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := ParsePoolMode(config.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	poolType, err := ParsePoolType(config.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	router, err := NewRouter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwtRouter *JWTClaimRouter
+	if config.JWTClaimRoute != nil {
+		if jwtRouter, err = NewJWTClaimRouter(*config.JWTClaimRoute); err != nil {
+			return nil, err
+		}
+	}
+
+	var splitter *ReadWriteSplitter
+	if config.ReadWriteSplit != nil {
+		if poolType != Primary {
+			return nil, fmt.Errorf("read_write_split is only allowed in primary pools")
+		}
+		if splitter, err = NewReadWriteSplitter(*config.ReadWriteSplit); err != nil {
+			return nil, err
+		}
+	}
+
+	pool := &ServerPool{
+		Name:                 name,
+		Router:               router,
+		JWTRouter:            jwtRouter,
+		Splitter:             splitter,
+		Mode:                 mode,
+		Type:                 poolType,
+		HealthCheckInterval:  config.HealthCheckInterval,
+		HealthCheckTimeout:   config.HealthCheckTimeout,
+		HealthScoreThreshold: config.HealthScoreThreshold,
+	}
+	pool.SetStrategy(strategy)
+	pool.SetLatencyEpsilon(options.LatencyEpsilon)
+
+	for _, backend := range config.Backends {
+		server, err := newServer(backend)
+		if err != nil {
+			return nil, err
+		}
+
+		pool.AddServer(server)
+		log.Printf("[%s] Configured instance: %s\n", name, server.URL)
+	}
+
+	log.Printf("[%s] Using %s strategy\n", name, strategy)
+	return pool, nil
+}
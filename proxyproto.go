@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// signature starting every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2Local = 0x20
+	proxyV2Proxy = 0x21
+	proxyV2TCP4  = 0x11
+	proxyV2TCP6  = 0x21
+)
+
+// writeProxyHeader writes a PROXY protocol v2 header telling the next hop
+// that the connection comes from src and was made to dst
+func writeProxyHeader(w io.Writer, src, dst net.Addr) error {
+	srcTCP, ok1 := src.(*net.TCPAddr)
+	dstTCP, ok2 := dst.(*net.TCPAddr)
+
+	var header bytes.Buffer
+	header.Write(proxyV2Signature)
+	if !ok1 || !ok2 {
+		// the addresses can't be described, the receiver uses the connection's own
+		header.Write([]byte{proxyV2Local, 0, 0, 0})
+		_, err := w.Write(header.Bytes())
+		return err
+	}
+
+	srcIP, dstIP := srcTCP.IP.To4(), dstTCP.IP.To4()
+	family, length := byte(proxyV2TCP4), uint16(12)
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16()
+		family, length = proxyV2TCP6, 36
+	}
+
+	header.Write([]byte{proxyV2Proxy, family})
+	binary.Write(&header, binary.BigEndian, length)
+	header.Write(srcIP)
+	header.Write(dstIP)
+	binary.Write(&header, binary.BigEndian, uint16(srcTCP.Port))
+	binary.Write(&header, binary.BigEndian, uint16(dstTCP.Port))
+	_, err := w.Write(header.Bytes())
+	return err
+}
+
+// readProxyHeader reads the PROXY protocol v2 header sent by the previous hop
+// and returns the source and destination it carries, nil for LOCAL headers
+// and address families other than TCP
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	prefix := make([]byte, 16)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(prefix[:12], proxyV2Signature) || prefix[12]>>4 != 2 {
+		return nil, nil, errors.New("no PROXY protocol v2 header")
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(prefix[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if prefix[12] != proxyV2Proxy {
+		return nil, nil, nil
+	}
+
+	size := 0
+	switch prefix[13] {
+	case proxyV2TCP4:
+		size = 4
+	case proxyV2TCP6:
+		size = 16
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("short PROXY protocol v2 header")
+	}
+
+	ports := body[2*size:]
+	src = &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(ports))}
+	dst = &net.TCPAddr{IP: net.IP(body[size : 2*size]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+	return src, dst, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// bodies larger than this are not searched for links
+const MAX_PUSH_BODY = 64 * 1024
+
+func GetPusherFromContext(r *http.Request) http.Pusher {
+	if pusher, ok := r.Context().Value(PusherKey).(http.Pusher); ok {
+		return pusher
+	}
+
+	return nil
+}
+
+// hateoasLinks extracts the _links.*.href values of a HAL style document,
+// a relation may hold a single link or a list of them
+func hateoasLinks(data []byte) []string {
+	var doc struct {
+		Links map[string]json.RawMessage `json:"_links"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil
+	}
+
+	type link struct {
+		Href string `json:"href"`
+	}
+
+	var hrefs []string
+	for _, raw := range doc.Links {
+		var one link
+		if err := json.Unmarshal(raw, &one); err == nil {
+			hrefs = append(hrefs, one.Href)
+			continue
+		}
+
+		var many []link
+		if err := json.Unmarshal(raw, &many); err == nil {
+			for _, l := range many {
+				hrefs = append(hrefs, l.Href)
+			}
+		}
+	}
+	return hrefs
+}
+
+// isLocalLink reports whether u is relative or points at the backend or the
+// host the client asked for, links to other hosts aren't served by the LB
+func isLocalLink(u *url.URL, r *http.Request) bool {
+	return u.Host == "" || strings.EqualFold(u.Host, r.URL.Host) || strings.EqualFold(u.Host, r.Host)
+}
+
+// PushLinks pushes the resources linked from a JSON response to HTTP/2
+// clients. Bodies that are too large or can't be parsed are left alone.
+func (route *Route) PushLinks(resp *http.Response) {
+	if !route.PushLinksFromHATEOAS || !isJSON(resp) {
+		return
+	}
+
+	pusher := GetPusherFromContext(resp.Request)
+	if pusher == nil {
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MAX_PUSH_BODY+1))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+	if err != nil || len(data) > MAX_PUSH_BODY {
+		return
+	}
+
+	pushed := 0
+	for _, href := range hateoasLinks(data) {
+		if pushed >= options.MaxPushResources {
+			break
+		}
+
+		u, err := url.Parse(href)
+		if err != nil || u.Path == "" || !isLocalLink(u, resp.Request) {
+			continue
+		}
+		// links may point at the backend host, push them as paths of the LB
+		if err := pusher.Push(u.RequestURI(), nil); err != nil {
+			if err != http.ErrNotSupported {
+				log.Printf("Could not push %s: %s\n", href, err)
+			}
+			return
+		}
+		pushed++
+	}
+}
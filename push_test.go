@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// recordingPusher keeps the targets pushed to it
+type recordingPusher struct {
+	targets []string
+}
+
+func (p *recordingPusher) Push(target string, _ *http.PushOptions) error {
+	p.targets = append(p.targets, target)
+	return nil
+}
+
+func TestPushLinksOnlyLocal(t *testing.T) {
+	setOptions(t, func(o *Options) { o.MaxPushResources = 10 })
+
+	body := []byte(`{"_links": {
+		"self": {"href": "/orders/1"},
+		"backend": {"href": "http://backend:9001/orders/1/items"},
+		"lb": {"href": "https://lb.example.com/customers/7"},
+		"other": {"href": "https://cdn.example.net/logo.png"},
+		"scheme_relative": [{"href": "//tracker.example.org/pixel"}]
+	}}`)
+
+	pusher := &recordingPusher{}
+	req := httptest.NewRequest(http.MethodGet, "http://backend:9001/orders/1", nil)
+	req.Host = "lb.example.com"
+	req = req.WithContext(context.WithValue(req.Context(), PusherKey, http.Pusher(pusher)))
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}
+
+	route := &Route{RouteOptions: RouteOptions{PushLinksFromHATEOAS: true}}
+	route.PushLinks(resp)
+
+	pushed := map[string]bool{}
+	for _, target := range pusher.targets {
+		pushed[target] = true
+	}
+	want := map[string]bool{"/orders/1": true, "/orders/1/items": true, "/customers/7": true}
+	if !reflect.DeepEqual(pushed, want) {
+		t.Errorf("pushed %v, want %v", pusher.targets, want)
+	}
+	if got, _ := io.ReadAll(resp.Body); !bytes.Equal(got, body) {
+		t.Errorf("body changed to %q", got)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// queuedRequest is a request waiting for a worker of its backend
+type queuedRequest struct {
+	w    http.ResponseWriter
+	r    *http.Request
+	done chan struct{}
+	// a panic of the proxy, raised again in the handler goroutine
+	panicked interface{}
+	// a retry or fallback handed back by the ErrorHandler, see handOff
+	next func()
+}
+
+// startQueue makes requests to the server wait in a queue of the given size,
+// served by workers goroutines forwarding them to the backend
+func (s *Server) startQueue(size, workers int) {
+	s.queue = make(chan *queuedRequest, size)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+}
+
+func (s *Server) work() {
+	for req := range s.queue {
+		s.forwardQueued(req)
+	}
+}
+
+func (s *Server) forwardQueued(req *queuedRequest) {
+	defer close(req.done)
+	defer func() {
+		req.panicked = recover()
+	}()
+
+	// the client went away while the request was queued
+	if req.r.Context().Err() != nil {
+		return
+	}
+	s.forward(req.w, req.r)
+}
+
+// Enqueue forwards the request through the queue of the server and waits for
+// it to be done. It returns false at once when the queue is full.
+func (s *Server) Enqueue(w http.ResponseWriter, r *http.Request) bool {
+	req := &queuedRequest{w: w, done: make(chan struct{})}
+	req.r = r.WithContext(context.WithValue(r.Context(), QueuedKey, req))
+	select {
+	case s.queue <- req:
+	default:
+		return false
+	}
+
+	<-req.done
+	if req.panicked != nil {
+		panic(req.panicked)
+	}
+	if req.next != nil {
+		req.next()
+	}
+	return true
+}
+
+// handOff runs next once the worker is done with the request when it came
+// through a queue, and at once otherwise. A worker waiting for a retry queued
+// on another backend could wait on a worker that waits for it in turn.
+func handOff(r *http.Request, next func()) {
+	if req, ok := r.Context().Value(QueuedKey).(*queuedRequest); ok {
+		select {
+		case <-req.done:
+			// the retry of a queued request, already back in the handler goroutine
+		default:
+			req.next = next
+			return
+		}
+	}
+	next()
+}
+
+// QueueDepth returns how many requests wait for a worker
+func (s *Server) QueueDepth() int {
+	return len(s.queue)
+}
+
+// forward proxies the request to the backend
+func (s *Server) forward(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&s.ActiveConns, 1)
+	defer atomic.AddInt64(&s.ActiveConns, -1)
+
+	if s.requestLog != nil {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() { s.requestLog.Log(r, sw.status, time.Since(start)) }()
+		w = sw
+	}
+	s.ReverseProxy.ServeHTTP(w, r)
+}
+
+// serveQueued is used by serve when the server has a queue
+func serveQueued(w http.ResponseWriter, r *http.Request, server *Server) {
+	if !server.Enqueue(w, r) {
+		log.Printf("[%s] request queue full, rejecting %s\n", server.URL.Host, r.URL.Path)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newResettingBackend closes the connections once it got a request on them, signalling each
+func newResettingBackend(t *testing.T) (string, chan struct{}) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := make(chan struct{}, 64)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Read(make([]byte, 4096))
+			conn.Close()
+			select {
+			case accepted <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return "http://" + listener.Addr().String(), accepted
+}
+
+func TestQueuedFallbackReleasesWorker(t *testing.T) {
+	setOptions(t, func(o *Options) {
+		o.BackendQueueSize = 8
+		o.BackendWorkers = 1
+	})
+
+	failing, accepted := newResettingBackend(t)
+	entered, release := make(chan struct{}, 8), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		io.WriteString(w, "ok")
+	}))
+	defer slow.Close()
+
+	pool, err := newServerPool("default", PoolConfig{Backends: []BackendConfig{{URL: failing}, {URL: slow.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setPool(t, pool)
+	servers := pool.Servers()
+
+	var wg sync.WaitGroup
+	request := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), pool, servers[0])
+		}()
+	}
+	defer wg.Wait()
+	defer close(release)
+
+	// the request fails on the first backend and falls back to the slow one
+	request()
+	select {
+	case <-entered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request didn't fall back to the other backend")
+	}
+	for len(accepted) > 0 {
+		<-accepted
+	}
+
+	// the worker of the first backend must not be held by the fallback
+	request()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("queued request not forwarded while the fallback of the previous one waits")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiter is set when -rate-limit is given
+var rateLimiter *RateLimiter
+
+// RateLimiter limits the requests per second of each client IP
+type RateLimiter struct {
+	limit int64
+	rates sync.Map
+	// requests currently held by the tarpit
+	tarpitted int64
+}
+
+func NewRateLimiter(limit int64) *RateLimiter {
+	l := &RateLimiter{limit: limit}
+	go cleanupRates(&l.rates)
+	return l
+}
+
+func (l *RateLimiter) Allow(ip string) bool {
+	rate, _ := l.rates.LoadOrStore(ip, &connRate{})
+	return rate.(*connRate).allow(time.Now(), l.limit)
+}
+
+// Reject answers a rate-limited request with a 429. With -tarpit-delay the
+// answer is held back that long to tie up the client's connection, unless
+// -max-tarpitted requests are already held.
+func (l *RateLimiter) Reject(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestsRateLimited, 1)
+
+	if options.TarpitDelay > 0 {
+		if atomic.AddInt64(&l.tarpitted, 1) <= options.MaxTarpitted {
+			done := make(chan struct{})
+			go func() {
+				time.Sleep(options.TarpitDelay)
+				close(done)
+			}()
+
+			select {
+			case <-done:
+			case <-r.Context().Done():
+			}
+		}
+		atomic.AddInt64(&l.tarpitted, -1)
+	}
+
+	log.Printf("%s(%s) exceeded %d requests per second\n", clientIP(r), r.URL.Path, l.limit)
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReplayBypassesRateLimit(t *testing.T) {
+	setOptions(t, func(o *Options) { o.RateLimit = 1 })
+	previous := rateLimiter
+	rateLimiter = NewRateLimiter(options.RateLimit)
+	t.Cleanup(func() { rateLimiter = previous })
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	pool, err := newServerPool("default", PoolConfig{Backends: []BackendConfig{{URL: backend.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setPool(t, pool)
+
+	replay := replayHandler(vhosts)
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		replay(w, httptest.NewRequest(http.MethodPost, "/admin/replay", strings.NewReader(`{"path": "/"}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("replay %d got %d, want replays to bypass the rate limit", i+1, w.Code)
+		}
+	}
+
+	codes := make([]int, 2)
+	for i := range codes {
+		w := httptest.NewRecorder()
+		loadBalance(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		codes[i] = w.Code
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("client requests got %v, want the second one over the limit rate limited", codes)
+	}
+}
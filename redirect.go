@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+func GetRedirectsFromContext(r *http.Request) int {
+	if redirects, ok := r.Context().Value(Redirects).(int); ok {
+		return redirects
+	}
+
+	return 0
+}
+
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectTransport follows the redirects of a backend to itself with
+// -follow-redirects, up to -max-redirects of them, so the client only gets
+// the final response. Redirects to other hosts are passed on to the client.
+type redirectTransport struct {
+	next http.RoundTripper
+	max  int
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || !isRedirect(resp.StatusCode) {
+			return resp, err
+		}
+
+		redirects := GetRedirectsFromContext(req)
+		next := t.follow(req, resp, redirects)
+		if next == nil {
+			return resp, nil
+		}
+
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		req = next
+	}
+}
+
+// follow returns the request for the redirect, nil when it is not followed
+func (t *redirectTransport) follow(req *http.Request, resp *http.Response, redirects int) *http.Request {
+	if redirects >= t.max {
+		return nil
+	}
+
+	location, err := req.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || location.Host != req.URL.Host {
+		return nil
+	}
+
+	method := req.Method
+	keepBody := resp.StatusCode == http.StatusTemporaryRedirect || resp.StatusCode == http.StatusPermanentRedirect
+	if !keepBody && method != http.MethodHead {
+		method = http.MethodGet
+	}
+
+	next := req.Clone(context.WithValue(req.Context(), Redirects, redirects+1))
+	next.Method = method
+	next.URL = location
+	if keepBody && req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil
+		}
+		next.Body = body
+	} else if !keepBody {
+		next.Body = nil
+		next.ContentLength = 0
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	}
+	return next
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport
+func (t *redirectTransport) CloseIdleConnections() {
+	if next, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		next.CloseIdleConnections()
+	}
+}
+
+// rewriteLocation points redirects from the backend to itself at the LB, so
+// the client doesn't bypass it
+func rewriteLocation(resp *http.Response) {
+	if !options.FollowRedirects || !isRedirect(resp.StatusCode) {
+		return
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || location.Host != resp.Request.URL.Host {
+		return
+	}
+
+	location.Scheme = "http"
+	if proto := resp.Request.Header.Get("X-Forwarded-Proto"); proto != "" {
+		location.Scheme = proto
+	}
+	location.Host = resp.Request.Host
+	resp.Header.Set("Location", location.String())
+}
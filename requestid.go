@@ -0,0 +1,24 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// setRequestID keeps the request ID sent by the client or makes one up, and
+// passes it on to the backend and back to the client under -request-id-header
+func setRequestID(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(options.RequestIDHeader)
+	if id == "" {
+		id = newRequestID()
+		r.Header.Set(options.RequestIDHeader, id)
+	}
+	w.Header().Set(options.RequestIDHeader, id)
+}
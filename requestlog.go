@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// requestLog writes the requests proxied to one backend to its own file
+type requestLog struct {
+	path string
+
+	mux    sync.Mutex
+	file   *os.File
+	logger *log.Logger
+}
+
+func openRequestLog(path string) (*requestLog, error) {
+	l := &requestLog{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open must be called with mux held, or before the log is shared
+func (l *requestLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	l.file = f
+	l.logger = log.New(f, "", log.LstdFlags)
+	return nil
+}
+
+// Rotate moves the file aside with a timestamp suffix and starts a new one
+func (l *requestLog) Rotate() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	rotated := fmt.Sprintf("%s.%s", l.path, time.Now().Format("20060102-150405"))
+	if err := os.Rename(l.path, rotated); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	old := l.file
+	if err := l.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+func (l *requestLog) Log(r *http.Request, status int, elapsed time.Duration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.logger.Printf("%s %s %s %d %s %s\n", clientIP(r), r.Method, r.URL.RequestURI(), status, elapsed, r.Header.Get(options.RequestIDHeader))
+}
+
+// rotateRequestLogs rotates the request logs of every backend, on SIGHUP
+func rotateRequestLogs(vhosts *VHostRouter) {
+	for _, pool := range vhosts.Pools() {
+		for _, s := range pool.Servers() {
+			if s.requestLog == nil {
+				continue
+			}
+			if err := s.requestLog.Rotate(); err != nil {
+				log.Printf("[%s] could not rotate request log: %s\n", s.URL, err)
+			}
+		}
+	}
+	log.Println("Request logs rotated")
+}
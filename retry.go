@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var defaultNonRetryableStatusCodes = []int{400, 401, 403, 404, 405, 422, 501}
+
+// isConnectionError reports whether err comes from talking to the backend
+// rather than from handling its response, only those are retried
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// errRetryableBody is returned by ModifyResponse for responses that carry one
+// of the RetryOnBodyContains strings, so ErrorHandler retries them
+var errRetryableBody = errors.New("retryable response body")
+
+// MAX_RETRY_BODY bounds the response bodies searched by CheckRetryableBody
+const MAX_RETRY_BODY = 4 << 10
+
+// MAX_REPLAYED_BODY bounds the request bodies buffered for retries, longer
+// ones are proxied as is and can't be retried on their response body
+const MAX_REPLAYED_BODY = 1 << 20
+
+// CheckRetryableBody returns errRetryableBody when the start of an uncompressed
+// response body contains one of the RetryOnBodyContains strings
+func (route *Route) CheckRetryableBody(resp *http.Response) error {
+	if len(route.RetryOnBodyContains) == 0 || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MAX_RETRY_BODY))
+	resp.Body = limitedBody{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+	if err != nil {
+		return err
+	}
+
+	for _, s := range route.RetryOnBodyContains {
+		if bytes.Contains(data, []byte(s)) {
+			return fmt.Errorf("%w: %q", errRetryableBody, s)
+		}
+	}
+	return nil
+}
+
+// bufferRequestBody keeps the body of the request so retries can send it
+// again, see replayBody
+func bufferRequestBody(r *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, MAX_REPLAYED_BODY+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > MAX_REPLAYED_BODY {
+		r.Body = limitedBody{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+		return nil
+	}
+
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return nil
+}
+
+// canReplayBody reports whether the request can be sent again with its body
+func canReplayBody(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+}
+
+// replayBody returns the request with its buffered body rewound
+func replayBody(r *http.Request) *http.Request {
+	if r.GetBody == nil {
+		return r
+	}
+
+	body, err := r.GetBody()
+	if err != nil {
+		return r
+	}
+	r = r.WithContext(r.Context())
+	r.Body = body
+	return r
+}
+
+// retryLimiter is set unless -max-retry-factor is 0
+var retryLimiter *RetryLimiter
+
+// RetryLimiter caps the retries made across all requests at factor times the
+// requests received within the last second, so that backends that are all
+// down don't get a multiple of the traffic in retries
+type RetryLimiter struct {
+	// requests count as successes, retries as failures
+	window *slidingWindow
+	factor float64
+	active int32
+}
+
+func NewRetryLimiter(factor float64) *RetryLimiter {
+	return &RetryLimiter{window: newSlidingWindow(time.Second), factor: factor}
+}
+
+// Request counts a request received from a client
+func (l *RetryLimiter) Request() {
+	l.window.Add(time.Now(), false)
+}
+
+// Allow tells whether a request may start retrying, requests that already
+// retry are left to finish
+func (l *RetryLimiter) Allow() bool {
+	total, retries := l.window.Counts(time.Now())
+	if float64(retries) >= float64(total-retries)*l.factor {
+		if atomic.CompareAndSwapInt32(&l.active, 0, 1) {
+			log.Printf("Retry limiter active, more than %g retries per request within a second\n", l.factor)
+		}
+		return false
+	}
+
+	if atomic.CompareAndSwapInt32(&l.active, 1, 0) {
+		log.Println("Retry limiter released")
+	}
+	return true
+}
+
+// Retry counts a retry
+func (l *RetryLimiter) Retry() {
+	l.window.Add(time.Now(), true)
+}
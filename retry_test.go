@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRetryOnBodyContains(t *testing.T) {
+	setOptions(t, nil)
+
+	var mux sync.Mutex
+	var bodies []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mux.Lock()
+		bodies = append(bodies, string(body))
+		calls := len(bodies)
+		mux.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if calls == 1 {
+			io.WriteString(w, `{"error": "temporarily_unavailable"}`)
+			return
+		}
+		io.WriteString(w, `{"ok": true}`)
+	}))
+	defer backend.Close()
+
+	pool, err := newServerPool("default", PoolConfig{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		Routes: []RouteConfig{{
+			Path:         "/api",
+			RouteOptions: RouteOptions{RetryOnBodyContains: []string{"temporarily_unavailable"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setPool(t, pool)
+
+	w := httptest.NewRecorder()
+	loadBalance(w, httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(`{"id": 1}`)))
+
+	if w.Code != http.StatusOK || w.Body.String() != `{"ok": true}` {
+		t.Fatalf("got %d %q, want the response of the retry", w.Code, w.Body.String())
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("backend got %d requests, want 2", len(bodies))
+	}
+	for i, body := range bodies {
+		if body != `{"id": 1}` {
+			t.Errorf("request %d had body %q, want it sent unchanged", i+1, body)
+		}
+	}
+	if !pool.Servers()[0].IsAlive() {
+		t.Error("backend answering with an error body was marked down")
+	}
+}
+
+func TestRetryOnBodyContainsOtherRoute(t *testing.T) {
+	setOptions(t, nil)
+
+	calls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		io.WriteString(w, `{"error": "temporarily_unavailable"}`)
+	}))
+	defer backend.Close()
+
+	pool, err := newServerPool("default", PoolConfig{
+		Backends: []BackendConfig{{URL: backend.URL}},
+		Routes: []RouteConfig{{
+			Path:         "/api",
+			RouteOptions: RouteOptions{RetryOnBodyContains: []string{"temporarily_unavailable"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setPool(t, pool)
+
+	w := httptest.NewRecorder()
+	loadBalance(w, httptest.NewRequest(http.MethodGet, "/other", nil))
+
+	if w.Code != http.StatusOK || calls != 1 {
+		t.Fatalf("got %d after %d requests, want the error body passed on as is", w.Code, calls)
+	}
+}
+
+func TestRetryOnBodyContainsNonRetryableStatus(t *testing.T) {
+	setOptions(t, nil)
+
+	calls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		io.WriteString(w, `{"error": "temporarily_unavailable"}`)
+	}))
+	defer backend.Close()
+
+	pool, err := newServerPool("default", PoolConfig{
+		Backends:     []BackendConfig{{URL: backend.URL}},
+		RouteOptions: RouteOptions{RetryOnBodyContains: []string{"temporarily_unavailable"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setPool(t, pool)
+
+	w := httptest.NewRecorder()
+	loadBalance(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusUnprocessableEntity || calls != 1 {
+		t.Fatalf("got %d after %d requests, want the 422 passed on without a retry", w.Code, calls)
+	}
+}
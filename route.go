@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// headers that survive a response header allow-list
+var standardResponseHeaders = []string{
+	"Cache-Control",
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Type",
+	"Date",
+	"Etag",
+	"Last-Modified",
+	"Location",
+	"Transfer-Encoding",
+	"Vary",
+}
+
+// RouteOptions are the per-route settings. The top-level config holds the
+// ones used for requests that match no route.
+type RouteOptions struct {
+	ResponseHeaderAllowList []string `yaml:"response_header_allow_list"`
+	ResponseHeaderDenyList  []string `yaml:"response_header_deny_list"`
+	// last resort for backends that send the wrong status, e.g. {200: 201}
+	StatusCodeRewrite map[int]int `yaml:"status_code_rewrite"`
+	// opens when too many requests to the route fail, nil disables it
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker"`
+	// text/template rendered with the decoded JSON response as data
+	ResponseBodyTemplate string `yaml:"response_body_template"`
+	// only filters RetryOnBodyContains: responses with these codes aren't retried for their body,
+	// nil uses defaultNonRetryableStatusCodes. Status codes alone never cause a retry.
+	NonRetryableStatusCodes []int `yaml:"non_retryable_status_codes"`
+	// push resources linked from _links of JSON responses to HTTP/2 clients
+	PushLinksFromHATEOAS bool `yaml:"push_links_from_hateoas"`
+	// decompress gzip responses for clients that didn't accept gzip
+	NormalizeEncoding bool `yaml:"normalize_encoding"`
+	// send DELETE and PURGE requests to every alive backend, for cache invalidation
+	FanOut bool `yaml:"fan_out"`
+	// send the requests to other pools at given times of day
+	Schedule []ScheduleEntry `yaml:"schedule"`
+	// proxy the request wrapped in the JSON body instead, see unwrapEnvelope
+	UnwrapEnvelope bool `yaml:"unwrap_envelope"`
+	// JSONPath expressions of response body fields added to the access log
+	LogResponseFields []string `yaml:"log_response_fields"`
+	// send requests to the backend with another method, e.g. {DELETE: POST}
+	MethodRewrite map[string]string `yaml:"method_rewrite"`
+	// add the original method of rewritten requests as a _method query parameter
+	MethodOverrideParam bool `yaml:"method_override_param"`
+	// retry responses with one of these strings in the first 4 KB of the body, whatever the status
+	RetryOnBodyContains []string `yaml:"retry_on_body_contains"`
+}
+
+type RouteConfig struct {
+	Path         string `yaml:"path"`
+	RouteOptions `yaml:",inline"`
+}
+
+type Route struct {
+	Path string
+	RouteOptions
+
+	allowedHeaders map[string]bool
+	breaker        *RouteCircuitBreaker
+	bodyTemplate   *template.Template
+	schedule       []scheduleWindow
+	methodRewrite  map[string]string
+
+	// replaces the request before it is proxied, nil keeps it
+	UnwrapRequest func(*http.Request) (*http.Request, error)
+}
+
+func NewRoute(path string, options RouteOptions) (*Route, error) {
+	route := &Route{Path: path, RouteOptions: options}
+
+	if options.ResponseBodyTemplate != "" {
+		tmpl, err := template.New(path).Parse(options.ResponseBodyTemplate)
+		if err != nil {
+			return nil, err
+		}
+		route.bodyTemplate = tmpl
+	}
+
+	if len(options.MethodRewrite) > 0 {
+		route.methodRewrite = newMethodRewrite(options.MethodRewrite)
+	}
+
+	if options.UnwrapEnvelope {
+		route.UnwrapRequest = unwrapEnvelope
+	}
+
+	for _, entry := range options.Schedule {
+		window, err := newScheduleWindow(entry)
+		if err != nil {
+			return nil, err
+		}
+		route.schedule = append(route.schedule, window)
+	}
+
+	if options.CircuitBreaker != nil {
+		route.breaker = NewRouteCircuitBreaker(path, *options.CircuitBreaker)
+	}
+
+	if len(options.ResponseHeaderAllowList) > 0 {
+		route.allowedHeaders = make(map[string]bool)
+		for _, h := range standardResponseHeaders {
+			route.allowedHeaders[h] = true
+		}
+		for _, h := range options.ResponseHeaderAllowList {
+			route.allowedHeaders[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+	return route, nil
+}
+
+// IsNonRetryable reports whether responses with the code are passed on
+// without checking RetryOnBodyContains
+func (route *Route) IsNonRetryable(code int) bool {
+	codes := route.NonRetryableStatusCodes
+	if codes == nil {
+		codes = defaultNonRetryableStatusCodes
+	}
+
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterResponseHeaders drops headers not in the allow-list and those in the deny-list
+func (route *Route) FilterResponseHeaders(header http.Header) {
+	if route.allowedHeaders != nil {
+		for name := range header {
+			if !route.allowedHeaders[name] {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range route.ResponseHeaderDenyList {
+		header.Del(name)
+	}
+}
+
+// RewriteStatus replaces the response status according to StatusCodeRewrite
+func (route *Route) RewriteStatus(resp *http.Response) {
+	code, ok := route.StatusCodeRewrite[resp.StatusCode]
+	if !ok {
+		return
+	}
+
+	log.Printf("[%s] rewriting status %d to %d\n", resp.Request.URL.Host, resp.StatusCode, code)
+	resp.StatusCode = code
+	resp.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+}
+
+// noRoute applies no rules, used when a request carries no route
+var noRoute = &Route{Path: "/"}
+
+// MAX_TEMPLATE_BODY bounds the response bodies decoded by RenderBody
+const MAX_TEMPLATE_BODY = 1 << 20
+
+// RenderBody reshapes JSON responses with ResponseBodyTemplate. Bodies that
+// are over MAX_TEMPLATE_BODY or can't be decoded or rendered are passed on
+// untouched.
+func (route *Route) RenderBody(resp *http.Response) {
+	if route.bodyTemplate == nil || !isJSON(resp) {
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MAX_TEMPLATE_BODY+1))
+	resp.Body = limitedBody{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+	if err != nil {
+		log.Printf("[%s] could not read response body: %s\n", resp.Request.URL.Host, err)
+		return
+	}
+	if len(data) > MAX_TEMPLATE_BODY {
+		log.Printf("WARN [%s] response to %s is over %d bytes, passing it on untemplated\n", resp.Request.URL.Host, resp.Request.URL.Path, MAX_TEMPLATE_BODY)
+		return
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return
+	}
+
+	var out bytes.Buffer
+	if err := route.bodyTemplate.Execute(&out, doc); err != nil {
+		log.Printf("[%s] could not render response body: %s\n", resp.Request.URL.Host, err)
+		return
+	}
+	replaceBody(resp, out.Bytes())
+}
+
+// Router matches requests to routes by the longest path prefix
+type Router struct {
+	routes   []*Route
+	fallback *Route
+}
+
+func NewRouter(config PoolConfig) (*Router, error) {
+	fallback, err := NewRoute("/", config.RouteOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	router := &Router{fallback: fallback}
+	for _, rc := range config.Routes {
+		// header lists strip what must not leak, a route keeps the top-level ones unless it has its own
+		if rc.ResponseHeaderAllowList == nil {
+			rc.ResponseHeaderAllowList = config.ResponseHeaderAllowList
+		}
+		if rc.ResponseHeaderDenyList == nil {
+			rc.ResponseHeaderDenyList = config.ResponseHeaderDenyList
+		}
+		route, err := NewRoute(rc.Path, rc.RouteOptions)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", rc.Path, err)
+		}
+		router.routes = append(router.routes, route)
+	}
+	return router, nil
+}
+
+// Routes returns every route, the fallback first
+func (router *Router) Routes() []*Route {
+	return append([]*Route{router.fallback}, router.routes...)
+}
+
+func (router *Router) Match(r *http.Request) *Route {
+	match := router.fallback
+	for _, route := range router.routes {
+		if strings.HasPrefix(r.URL.Path, route.Path) && len(route.Path) > len(match.Path) {
+			match = route
+		}
+	}
+	return match
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRoutesInheritHeaderLists(t *testing.T) {
+	var config PoolConfig
+	err := yaml.Unmarshal([]byte(`
+response_header_deny_list: [X-Powered-By]
+routes:
+  - path: /api
+    status_code_rewrite: {200: 201}
+  - path: /debug
+    response_header_deny_list: []
+  - path: /internal
+    response_header_deny_list: [Server]
+`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path      string
+		poweredBy bool
+		server    bool
+	}{
+		{"/", false, true},
+		{"/api/x", false, true},
+		{"/debug", true, true},
+		{"/internal", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			header := http.Header{"X-Powered-By": {"php"}, "Server": {"nginx"}}
+			router.Match(httptest.NewRequest(http.MethodGet, tt.path, nil)).FilterResponseHeaders(header)
+
+			if got := header.Get("X-Powered-By") != ""; got != tt.poweredBy {
+				t.Errorf("X-Powered-By kept %t, want %t", got, tt.poweredBy)
+			}
+			if got := header.Get("Server") != ""; got != tt.server {
+				t.Errorf("Server kept %t, want %t", got, tt.server)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ScheduleEntry sends the requests of a route to another pool during a daily
+// time window, given as 24h UTC times like "22:00". Windows may span midnight.
+type ScheduleEntry struct {
+	StartTime string `yaml:"start_time"`
+	EndTime   string `yaml:"end_time"`
+	// name of a pool from the pools section
+	PoolName string `yaml:"pool_name"`
+}
+
+// scheduleWindow is a parsed ScheduleEntry, in minutes since midnight UTC
+type scheduleWindow struct {
+	start, end int
+	pool       string
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func newScheduleWindow(entry ScheduleEntry) (scheduleWindow, error) {
+	start, err := parseClock(entry.StartTime)
+	if err != nil {
+		return scheduleWindow{}, err
+	}
+	end, err := parseClock(entry.EndTime)
+	if err != nil {
+		return scheduleWindow{}, err
+	}
+	if entry.PoolName == "" {
+		return scheduleWindow{}, fmt.Errorf("schedule entry %s-%s needs a pool_name", entry.StartTime, entry.EndTime)
+	}
+	return scheduleWindow{start: start, end: end, pool: entry.PoolName}, nil
+}
+
+func (w scheduleWindow) contains(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// ScheduledPool returns the pool of the first schedule entry covering now,
+// empty when none does
+func (route *Route) ScheduledPool(now time.Time) string {
+	now = now.UTC()
+	minute := now.Hour()*60 + now.Minute()
+	for _, w := range route.schedule {
+		if w.contains(minute) {
+			return w.pool
+		}
+	}
+	return ""
+}
@@ -1,24 +1,314 @@
 package main
 
 import (
+	"context"
+	"log"
 	"net/http/httputil"
 	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const DEFAULT_EWMA_ALPHA = 0.1
+const WEIGHT_PENALTY = 4
+
 type Server struct {
-	URL          *url.URL
-	Alive        bool
+	URL    *url.URL
+	Alive  bool
+	Weight int
+	// lower is preferred, higher tiers only get traffic when all lower ones are down
+	Priority     int
+	UseHTTP2     bool
 	mux          sync.RWMutex
 	ReverseProxy *httputil.ReverseProxy
+
+	// moving average of response latency in milliseconds, guarded by mux
+	LatencyEWMA float64
+	EWMAAlpha   float64
+
+	// draining servers get no new requests, guarded by mux
+	Draining bool
+	// requests currently being proxied, updated atomically
+	ActiveConns int64
+	// connections open to the backend, updated atomically
+	OpenConns int64
+
+	// guarded by mux
+	LastSeenAlive    time.Time
+	LastStatusChange time.Time
+	// the weight is divided by WEIGHT_PENALTY until then
+	penaltyUntil time.Time
+	// replaces Weight once set by -auto-weight
+	autoWeight int
+
+	// HTTP health check, both empty for a TCP connect
+	HealthCheckPath      string
+	HealthCheckJSONPath  string
+	HealthCheckJSONValue string
+	// failed health checks keep the server alive for this long after AddServer
+	InitialGracePeriod time.Duration
+	// end of the grace period, zero once it expired, guarded by mux
+	graceUntil time.Time
+
+	// P99 latency target, 0 when the backend has none
+	SLOP99 time.Duration
+	// health checks that found the P99 above SLOP99, updated atomically
+	SLOViolations uint64
+	// guarded by mux
+	latencies    latencySamples
+	sloCheckedAt time.Time
+
+	// nil unless the backend has a log_file
+	requestLog *requestLog
+
+	// nil unless -backend-queue-size is set
+	queue chan *queuedRequest
+}
+
+// ServerStatus is the admin API view of a server
+type ServerStatus struct {
+	URL              string    `json:"url"`
+	Alive            bool      `json:"alive"`
+	Draining         bool      `json:"draining"`
+	Weight           int       `json:"weight"`
+	EffectiveWeight  int       `json:"effective_weight"`
+	Priority         int       `json:"priority"`
+	ActiveConns      int64     `json:"active_conns"`
+	LatencyEWMA      float64   `json:"latency_ewma_ms"`
+	LastSeenAlive    time.Time `json:"last_seen_alive"`
+	LastStatusChange time.Time `json:"last_status_change"`
 }
 
 func (s *Server) IsAlive() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 	return s.Alive
 }
 
 func (s *Server) SetAlive(alive bool) {
+	now := time.Now()
+
 	s.mux.Lock()
+	if alive != s.Alive {
+		s.LastStatusChange = now
+	}
+	if alive {
+		s.LastSeenAlive = now
+	}
+	changed := alive != s.Alive
 	s.Alive = alive
 	s.mux.Unlock()
+
+	// SetAlive runs on every health check, only status changes are worth a write
+	if changed && stateStore != nil {
+		stateStore.Save(s.URL.String(), alive, now)
+	}
+	if changed && !alive {
+		events.Publish(Event{Type: "backend_down", Backend: s.URL.String(), Message: "backend marked down"})
+	}
+}
+
+// GetWeight returns the weight used for selection, as tuned by -auto-weight
+// and lowered while a penalty is active
+func (s *Server) GetWeight() int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	weight := s.Weight
+	if s.autoWeight > 0 {
+		weight = s.autoWeight
+	}
+	if time.Now().Before(s.penaltyUntil) {
+		if w := weight / WEIGHT_PENALTY; w > 0 {
+			return w
+		}
+		return 1
+	}
+	return weight
+}
+
+// BaseWeight returns the configured weight of the server
+func (s *Server) BaseWeight() int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.Weight
+}
+
+// SetWeight changes the configured weight of the server. Its idle backend
+// connections are closed so that stale ones aren't kept past a config change.
+func (s *Server) SetWeight(weight int) {
+	s.mux.Lock()
+	s.Weight = weight
+	s.autoWeight = 0
+	s.mux.Unlock()
+
+	s.CloseIdleConnections()
+}
+
+// CloseIdleConnections closes the connections to the backend not serving a request
+func (s *Server) CloseIdleConnections() {
+	if t, ok := s.ReverseProxy.Transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// SetAutoWeight replaces the weight of the server and returns the previous one
+func (s *Server) SetAutoWeight(weight int) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	previous := s.Weight
+	if s.autoWeight > 0 {
+		previous = s.autoWeight
+	}
+	s.autoWeight = weight
+	return previous
+}
+
+// PenalizeWeight lowers the weight of the server for d
+func (s *Server) PenalizeWeight(d time.Duration) {
+	s.mux.Lock()
+	s.penaltyUntil = time.Now().Add(d)
+	s.mux.Unlock()
+}
+
+// IsPenalized reports whether a penalty set by PenalizeWeight is active
+func (s *Server) IsPenalized() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return time.Now().Before(s.penaltyUntil)
+}
+
+// StartGracePeriod starts the InitialGracePeriod of the server
+func (s *Server) StartGracePeriod() {
+	if s.InitialGracePeriod <= 0 {
+		return
+	}
+
+	s.mux.Lock()
+	s.graceUntil = time.Now().Add(s.InitialGracePeriod)
+	s.mux.Unlock()
+	log.Printf("%s in its initial grace period for %s\n", s.URL, s.InitialGracePeriod)
+}
+
+// InGracePeriod reports whether failed health checks should be ignored
+// because the server was only just added
+func (s *Server) InGracePeriod() bool {
+	s.mux.Lock()
+	if s.graceUntil.IsZero() {
+		s.mux.Unlock()
+		return false
+	}
+	if time.Now().Before(s.graceUntil) {
+		s.mux.Unlock()
+		return true
+	}
+	s.graceUntil = time.Time{}
+	s.mux.Unlock()
+
+	log.Printf("%s initial grace period expired\n", s.URL)
+	return false
+}
+
+// DownFor returns how long the server has been down, 0 while it is alive
+func (s *Server) DownFor() time.Duration {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if s.Alive {
+		return 0
+	}
+	return time.Since(s.LastSeenAlive)
+}
+
+func (s *Server) Status() ServerStatus {
+	weight := s.GetWeight()
+
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return ServerStatus{
+		URL:              s.URL.String(),
+		Alive:            s.Alive,
+		Draining:         s.Draining,
+		Weight:           s.Weight,
+		EffectiveWeight:  weight,
+		Priority:         s.Priority,
+		ActiveConns:      s.GetActiveConns(),
+		LatencyEWMA:      s.LatencyEWMA,
+		LastSeenAlive:    s.LastSeenAlive,
+		LastStatusChange: s.LastStatusChange,
+	}
+}
+
+func (s *Server) IsDraining() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.Draining
+}
+
+func (s *Server) SetDraining(draining bool) {
+	s.mux.Lock()
+	s.Draining = draining
+	s.mux.Unlock()
+}
+
+// IsAvailable reports whether the server may receive new requests
+func (s *Server) IsAvailable() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.Alive && !s.Draining
+}
+
+func (s *Server) GetActiveConns() int64 {
+	return atomic.LoadInt64(&s.ActiveConns)
+}
+
+func (s *Server) GetOpenConns() int64 {
+	return atomic.LoadInt64(&s.OpenConns)
+}
+
+// GetIdleConns estimates the pooled connections not serving a request
+func (s *Server) GetIdleConns() int64 {
+	if idle := s.GetOpenConns() - s.GetActiveConns(); idle > 0 {
+		return idle
+	}
+	return 0
+}
+
+// WaitDrained blocks until no requests are in flight on the server or ctx is done
+func (s *Server) WaitDrained(ctx context.Context) error {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+
+	for s.GetActiveConns() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+// ObserveLatency folds a completed request latency into LatencyEWMA and the
+// samples used for percentiles
+func (s *Server) ObserveLatency(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+
+	s.mux.Lock()
+	s.latencies.Add(d, time.Now())
+	if s.LatencyEWMA == 0 {
+		s.LatencyEWMA = ms
+	} else {
+		s.LatencyEWMA = s.EWMAAlpha*ms + (1-s.EWMAAlpha)*s.LatencyEWMA
+	}
+	s.mux.Unlock()
+}
+
+func (s *Server) GetLatencyEWMA() float64 {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.LatencyEWMA
 }
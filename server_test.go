@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newCountingBackend starts a backend that counts the connections opened to it
+func newCountingBackend(t *testing.T) (*httptest.Server, *int64) {
+	t.Helper()
+
+	var conns int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	backend.Start()
+	t.Cleanup(backend.Close)
+	return backend, &conns
+}
+
+func proxyGet(t *testing.T, server *Server) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.ReverseProxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Fatalf("got %d %q, want 200 ok", w.Code, w.Body.String())
+	}
+}
+
+// forEachTransport runs the test with the default and the pipelining transport
+func forEachTransport(t *testing.T, test func(t *testing.T)) {
+	for _, pipelining := range []bool{false, true} {
+		name := "default"
+		if pipelining {
+			name = "pipelining"
+		}
+		t.Run(name, func(t *testing.T) {
+			setOptions(t, func(o *Options) {
+				o.BackendPipelining = pipelining
+				o.Transport.IdleConnTimeout = 50 * time.Millisecond
+			})
+			test(t)
+		})
+	}
+}
+
+func TestIdleTimeoutReconnects(t *testing.T) {
+	forEachTransport(t, func(t *testing.T) {
+		backend, conns := newCountingBackend(t)
+		server, err := newServer(BackendConfig{URL: backend.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proxyGet(t, server)
+		time.Sleep(200 * time.Millisecond)
+		proxyGet(t, server)
+
+		if n := atomic.LoadInt64(conns); n != 2 {
+			t.Errorf("backend got %d connections, want the idle one replaced by a new one", n)
+		}
+	})
+}
+
+func TestSetWeightClosesIdleConnections(t *testing.T) {
+	forEachTransport(t, func(t *testing.T) {
+		options.Transport.IdleConnTimeout = 90 * time.Second
+		backend, conns := newCountingBackend(t)
+		server, err := newServer(BackendConfig{URL: backend.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proxyGet(t, server)
+		proxyGet(t, server)
+		if n := atomic.LoadInt64(conns); n != 1 {
+			t.Fatalf("backend got %d connections, want the first one reused", n)
+		}
+
+		server.SetWeight(5)
+		if open := server.GetOpenConns(); open != 0 {
+			t.Errorf("%d connections still open after the weight change", open)
+		}
+		proxyGet(t, server)
+		if n := atomic.LoadInt64(conns); n != 2 {
+			t.Errorf("backend got %d connections, want a new one after the weight change", n)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type ReadWriteSplitConfig struct {
+	// name of a pool of type replica from the pools section
+	ReplicaPool string `yaml:"replica_pool"`
+	// send reads to the primary while every replica is down, nil is true.
+	// When false reads only ever go to replicas and get a 503 when none is up.
+	FallbackReadsToPrimary *bool `yaml:"fallback_reads_to_primary"`
+}
+
+// ReadWriteSplitter sends the reads received by a primary pool to its
+// replica pool. Writes stay on the primary.
+type ReadWriteSplitter struct {
+	ReplicaPool string
+	fallback    bool
+}
+
+func NewReadWriteSplitter(config ReadWriteSplitConfig) (*ReadWriteSplitter, error) {
+	if config.ReplicaPool == "" {
+		return nil, fmt.Errorf("read_write_split needs a replica_pool")
+	}
+
+	fallback := true
+	if config.FallbackReadsToPrimary != nil {
+		fallback = *config.FallbackReadsToPrimary
+	}
+	return &ReadWriteSplitter{ReplicaPool: config.ReplicaPool, fallback: fallback}, nil
+}
+
+func isRead(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// Route returns the pool for the request
+func (s *ReadWriteSplitter) Route(r *http.Request, primary *ServerPool) *ServerPool {
+	if !isRead(r) {
+		return primary
+	}
+
+	replicas := vhosts.Pool(s.ReplicaPool)
+	if replicas.AliveCount() == 0 && s.fallback {
+		return primary
+	}
+	return replicas
+}
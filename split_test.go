@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestReadWriteSplitterAllReplicasDown(t *testing.T) {
+	primary := &ServerPool{Name: "default"}
+	replicas := &ServerPool{Name: "replicas", Type: Replica}
+	replicas.AddServer(&Server{URL: &url.URL{Scheme: "http", Host: "replica"}, Alive: false, Weight: 1})
+	setPool(t, primary)
+	vhosts.AddPool(replicas)
+
+	tests := []struct {
+		name   string
+		config string
+		want   *ServerPool
+	}{
+		{"default", "replica_pool: replicas", primary},
+		{"fallback", "{replica_pool: replicas, fallback_reads_to_primary: true}", primary},
+		{"no fallback", "{replica_pool: replicas, fallback_reads_to_primary: false}", replicas},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config ReadWriteSplitConfig
+			if err := yaml.Unmarshal([]byte(tt.config), &config); err != nil {
+				t.Fatal(err)
+			}
+			splitter, err := NewReadWriteSplitter(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := splitter.Route(httptest.NewRequest(http.MethodGet, "/", nil), primary); got != tt.want {
+				t.Errorf("read went to %s, want %s", got.Name, tt.want.Name)
+			}
+			if got := splitter.Route(httptest.NewRequest(http.MethodPost, "/", nil), primary); got != primary {
+				t.Errorf("write went to %s, want the primary", got.Name)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var backendsBucket = []byte("backends")
+
+// stateStore is nil unless -state-db is given
+var stateStore *StateStore
+
+type backendState struct {
+	URL       string    `json:"url"`
+	Alive     bool      `json:"alive"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// StateStore persists backend status in an embedded BoltDB database so that
+// a restarted LB doesn't send traffic to backends it knew to be down. Writes
+// happen on a background goroutine, a crash can't leave a partial write.
+type StateStore struct {
+	db     *bolt.DB
+	writes chan backendState
+	done   chan struct{}
+
+	// guards writes against a Save racing with Close
+	mux    sync.Mutex
+	closed bool
+}
+
+func OpenStateStore(path string) (*StateStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(backendsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &StateStore{db: db, writes: make(chan backendState, 1024), done: make(chan struct{})}
+	go store.writer()
+	return store, nil
+}
+
+// Restore applies the stored status, if any, to the server
+func (store *StateStore) Restore(server *Server) {
+	var state backendState
+	found := false
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(backendsBucket).Get([]byte(server.URL.String()))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &state)
+	})
+	if err != nil {
+		log.Printf("[%s] could not restore state: %s\n", server.URL, err)
+		return
+	}
+	if !found {
+		return
+	}
+
+	server.mux.Lock()
+	server.Alive = state.Alive
+	server.LastStatusChange = state.Timestamp
+	if state.Alive {
+		server.LastSeenAlive = state.Timestamp
+	}
+	server.mux.Unlock()
+	log.Printf("[%s] restored state alive=%t from %s\n", server.URL, state.Alive, state.Timestamp.Format(time.RFC3339))
+}
+
+// Save queues a status write without blocking the caller, writes after Close
+// are dropped
+func (store *StateStore) Save(url string, alive bool, at time.Time) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	if store.closed {
+		return
+	}
+	select {
+	case store.writes <- backendState{URL: url, Alive: alive, Timestamp: at}:
+	default:
+		log.Printf("[%s] state write queue full, dropping update\n", url)
+	}
+}
+
+func (store *StateStore) writer() {
+	defer close(store.done)
+
+	for state := range store.writes {
+		data, err := json.Marshal(state)
+		if err == nil {
+			err = store.db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket(backendsBucket).Put([]byte(state.URL), data)
+			})
+		}
+		if err != nil {
+			log.Printf("[%s] could not save state: %s\n", state.URL, err)
+		}
+	}
+}
+
+// Close flushes the pending writes and closes the database
+func (store *StateStore) Close() error {
+	store.mux.Lock()
+	if store.closed {
+		store.mux.Unlock()
+		return nil
+	}
+	store.closed = true
+	close(store.writes)
+	store.mux.Unlock()
+
+	<-store.done
+	return store.db.Close()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, path string) *StateStore {
+	t.Helper()
+
+	store, err := OpenStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := stateStore
+	t.Cleanup(func() { stateStore = previous })
+	stateStore = store
+	return store
+}
+
+func TestStateStoreSavesStatusChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	store := openTestStore(t, path)
+
+	u, _ := url.Parse("http://127.0.0.1:9001")
+	server := &Server{URL: u, Alive: true}
+	server.SetAlive(false)
+	changed := server.LastStatusChange
+
+	// later ticks with the same status must not overwrite the time of the change
+	time.Sleep(10 * time.Millisecond)
+	server.SetAlive(false)
+	server.SetAlive(false)
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openTestStore(t, path)
+	defer store.Close()
+
+	restored := &Server{URL: u, Alive: true}
+	store.Restore(restored)
+	if restored.Alive {
+		t.Error("restored alive, want down")
+	}
+	if !restored.LastStatusChange.Equal(changed) {
+		t.Errorf("restored status change at %s, want %s", restored.LastStatusChange, changed)
+	}
+}
+
+func TestStateStoreSaveAfterClose(t *testing.T) {
+	store := openTestStore(t, filepath.Join(t.TempDir(), "state.db"))
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// health checks may still be running while the LB shuts down
+	store.Save("http://127.0.0.1:9001", false, time.Now())
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
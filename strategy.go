@@ -0,0 +1,87 @@
+package main
+
+import "fmt"
+
+// SelectionStrategy decides how the pool picks a backend for a request
+type SelectionStrategy int
+
+const (
+	RoundRobin SelectionStrategy = iota
+	Random
+	WeightedRandom
+	LatencyAware
+	LeastConnections
+)
+
+var strategyNames = map[SelectionStrategy]string{
+	RoundRobin:       "round-robin",
+	Random:           "random",
+	WeightedRandom:   "weighted-random",
+	LatencyAware:     "latency-aware",
+	LeastConnections: "least-connections",
+}
+
+func (s SelectionStrategy) String() string {
+	if name, ok := strategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("strategy(%d)", int(s))
+}
+
+// ParseStrategy maps a flag/config value to a SelectionStrategy
+func ParseStrategy(name string) (SelectionStrategy, error) {
+	if name == "" {
+		return RoundRobin, nil
+	}
+
+	for s, n := range strategyNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return RoundRobin, fmt.Errorf("unknown strategy %q", name)
+}
+
+// PoolMode decides whether a pool spreads traffic or keeps backends in standby
+type PoolMode int
+
+const (
+	Balanced PoolMode = iota
+	// all traffic goes to the first alive server, the others wait as standby
+	HotStandby
+)
+
+func ParsePoolMode(name string) (PoolMode, error) {
+	switch name {
+	case "", "balanced":
+		return Balanced, nil
+	case "hot-standby":
+		return HotStandby, nil
+	}
+	return Balanced, fmt.Errorf("unknown pool mode %q", name)
+}
+
+// PoolType tells the primary pool of a read/write split from its replicas
+type PoolType int
+
+const (
+	Primary PoolType = iota
+	Replica
+)
+
+func (t PoolType) String() string {
+	if t == Replica {
+		return "replica"
+	}
+	return "primary"
+}
+
+func ParsePoolType(name string) (PoolType, error) {
+	switch name {
+	case "", "primary":
+		return Primary, nil
+	case "replica":
+		return Replica, nil
+	}
+	return Primary, fmt.Errorf("unknown pool type %q", name)
+}
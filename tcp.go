@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TCPProxy forwards raw TCP connections to the servers of a pool, used
+// instead of the HTTP load balancer with -tcp
+type TCPProxy struct {
+	pool     *ServerPool
+	listener net.Listener
+	conns    sync.WaitGroup
+}
+
+func NewTCPProxy(pool *ServerPool, listener net.Listener) *TCPProxy {
+	return &TCPProxy{pool: pool, listener: listener}
+}
+
+// Serve accepts connections until the listener is closed
+func (p *TCPProxy) Serve() error {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		p.conns.Add(1)
+		go func() {
+			defer p.conns.Done()
+			p.handle(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for the open ones to end
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	p.listener.Close()
+
+	done := make(chan struct{})
+	go func() {
+		p.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *TCPProxy) handle(client net.Conn) {
+	defer client.Close()
+
+	reader := bufio.NewReader(client)
+	src, dst := client.RemoteAddr(), client.LocalAddr()
+	if options.AcceptProxyProtocol {
+		fromSrc, fromDst, err := readProxyHeader(reader)
+		if err != nil {
+			log.Printf("%s invalid PROXY protocol header: %s\n", src, err)
+			return
+		}
+		if fromSrc != nil {
+			src, dst = fromSrc, fromDst
+		}
+	}
+
+	server := p.pool.SelectServer()
+	if server == nil {
+		log.Printf("%s no backend available, closing\n", src)
+		return
+	}
+
+	backend, err := net.DialTimeout("tcp", server.URL.Host, options.Transport.DialTimeout)
+	if err != nil {
+		log.Printf("[%s] %s\n", server.URL.Host, err)
+		server.SetAlive(false)
+		return
+	}
+	defer backend.Close()
+
+	if options.EmitProxyProtocol {
+		if err := writeProxyHeader(backend, src, dst); err != nil {
+			log.Printf("[%s] could not write PROXY protocol header: %s\n", server.URL.Host, err)
+			return
+		}
+	}
+
+	atomic.AddInt64(&server.ActiveConns, 1)
+	defer atomic.AddInt64(&server.ActiveConns, -1)
+
+	start := time.Now()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, reader)
+		closeWrite(backend)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, backend)
+		closeWrite(client)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	log.Printf("%s -> %s closed after %s\n", src, server.URL.Host, time.Since(start))
+}
+
+// closeWrite tells the peer no more data follows, keeping the other direction open
+func closeWrite(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// TransportConfig tunes the connections to backends. Defaults match http.DefaultTransport.
+type TransportConfig struct {
+	DialTimeout         time.Duration `yaml:"dial_timeout"`
+	KeepAlive           time.Duration `yaml:"keep_alive"`
+	MaxIdleConns        int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	TLSHandshakeTimeout time.Duration `yaml:"tls_handshake_timeout"`
+	InsecureSkipVerify  bool          `yaml:"insecure_skip_verify"`
+	CheckOCSP           bool          `yaml:"check_ocsp"`
+}
+
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		DialTimeout:         30 * time.Second,
+		KeepAlive:           30 * time.Second,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// trackedConn keeps a count of the open connections to a backend
+type trackedConn struct {
+	net.Conn
+	open *int64
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(c.open, -1) })
+	return c.Conn.Close()
+}
+
+// newTransport builds the transport used to reach a single backend, so that
+// per-host limits are exact. Open connections are counted in openConns.
+func newTransport(config TransportConfig, keepAliveCount int, openConns *int64) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: config.KeepAlive,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// HTTP/1.1 unless -backend-h2 is given, http.DefaultTransport negotiates h2 with any TLS backend
+	transport.ForceAttemptHTTP2 = false
+	transport.MaxIdleConns = config.MaxIdleConns
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CheckOCSP {
+		transport.TLSClientConfig.VerifyPeerCertificate = verifyOCSP
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if tcpConn, ok := conn.(*net.TCPConn); ok && config.KeepAlive > 0 && keepAliveCount > 0 {
+			if err := setKeepAliveCount(tcpConn, keepAliveCount); err != nil {
+				log.Printf("[%s] could not set keepalive count: %s\n", addr, err)
+			}
+		}
+
+		atomic.AddInt64(openConns, 1)
+		return &trackedConn{Conn: conn, open: openConns}, nil
+	}
+	return transport
+}
+
+// H2_MAX_STREAMS bounds the requests in flight to a backend multiplexed over
+// HTTP/2. It stays within the stream limit of most servers, so the requests
+// share one connection instead of each dialing one past the limit.
+const H2_MAX_STREAMS = 100
+
+// multiplexTransport switches to HTTP/2 when a TLS backend negotiates h2 via
+// ALPN, and stays on HTTP/1.1 otherwise. Requests past H2_MAX_STREAMS wait for
+// a free stream. Until the first response, requests go one at a time so that
+// they don't each dial a connection before the first one is up.
+type multiplexTransport struct {
+	*http.Transport
+	streams chan struct{}
+
+	mux sync.Mutex
+	// 0 until the first response, then its major protocol version, updated atomically
+	proto int32
+}
+
+func newMultiplexTransport(transport *http.Transport) (*multiplexTransport, error) {
+	if _, err := http2.ConfigureTransports(transport); err != nil {
+		return nil, err
+	}
+	return &multiplexTransport{Transport: transport, streams: make(chan struct{}, H2_MAX_STREAMS)}, nil
+}
+
+func (t *multiplexTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt32(&t.proto) == 0 {
+		t.mux.Lock()
+		if atomic.LoadInt32(&t.proto) == 0 {
+			defer t.mux.Unlock()
+			resp, err := t.roundTrip(req)
+			if err == nil {
+				atomic.StoreInt32(&t.proto, int32(resp.ProtoMajor))
+			}
+			return resp, err
+		}
+		t.mux.Unlock()
+	}
+
+	if atomic.LoadInt32(&t.proto) != 2 {
+		return t.Transport.RoundTrip(req)
+	}
+	return t.roundTrip(req)
+}
+
+// roundTrip sends the request once a stream is free, the stream is only given
+// back when the response body is closed
+func (t *multiplexTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case t.streams <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	release := func() { <-t.streams }
+
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &streamBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// streamBody gives back the stream of a multiplexed response once closed
+type streamBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// newHTTP2Transport speaks HTTP/2 to the backend, negotiated over TLS for
+// https:// backends and as cleartext h2c for http:// ones. Connections are
+// dialed through base so keepalive tuning still applies.
+func newHTTP2Transport(u *url.URL, base *http.Transport) *http2.Transport {
+	if u.Scheme == "https" {
+		return &http2.Transport{
+			AllowHTTP:       false,
+			TLSClientConfig: base.TLSClientConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := base.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				tlsConn := tls.Client(conn, cfg)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+		}
+	}
+
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return base.DialContext(ctx, network, addr)
+		},
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTLSBackend starts a TLS backend, negotiating h2 when h2 is set, that
+// answers with the protocol of the request after delay
+func newTLSBackend(t *testing.T, h2 bool, delay time.Duration) (*httptest.Server, *int64) {
+	t.Helper()
+
+	var conns int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		io.WriteString(w, r.Proto)
+	}))
+	backend.EnableHTTP2 = h2
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	backend.StartTLS()
+	t.Cleanup(backend.Close)
+	return backend, &conns
+}
+
+func TestBackendH2(t *testing.T) {
+	for _, test := range []struct {
+		backendH2 bool
+		serverH2  bool
+		proto     string
+	}{
+		{false, true, "HTTP/1.1"},
+		{true, true, "HTTP/2.0"},
+		{true, false, "HTTP/1.1"},
+	} {
+		t.Run(fmt.Sprintf("backend-h2=%t/server-h2=%t", test.backendH2, test.serverH2), func(t *testing.T) {
+			setOptions(t, func(o *Options) {
+				o.BackendH2 = test.backendH2
+				o.Transport.InsecureSkipVerify = true
+			})
+			backend, _ := newTLSBackend(t, test.serverH2, 0)
+			server, err := newServer(BackendConfig{URL: backend.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			server.ReverseProxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != http.StatusOK || w.Body.String() != test.proto {
+				t.Errorf("got %d %q, want the backend to see %s", w.Code, w.Body.String(), test.proto)
+			}
+		})
+	}
+}
+
+// TestBackendH2ConcurrentClients measures the backend connections opened for
+// 1000 concurrent clients, with and without -backend-h2
+func TestBackendH2ConcurrentClients(t *testing.T) {
+	if testing.Short() {
+		t.Skip("opens up to 1000 connections")
+	}
+
+	const clients = 1000
+	conns := make(map[bool]int64)
+	for _, backendH2 := range []bool{false, true} {
+		setOptions(t, func(o *Options) {
+			o.BackendH2 = backendH2
+			o.Transport.InsecureSkipVerify = true
+		})
+		backend, opened := newTLSBackend(t, true, 50*time.Millisecond)
+		server, err := newServer(BackendConfig{URL: backend.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var failed int64
+		var wg sync.WaitGroup
+		start := time.Now()
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				server.ReverseProxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+				if w.Code != http.StatusOK {
+					atomic.AddInt64(&failed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		server.CloseIdleConnections()
+
+		conns[backendH2] = atomic.LoadInt64(opened)
+		t.Logf("backend-h2=%t: %d clients over %d backend connections in %s", backendH2, clients, conns[backendH2], time.Since(start).Round(time.Millisecond))
+		if failed > 0 {
+			t.Errorf("backend-h2=%t: %d of %d requests failed", backendH2, failed, clients)
+		}
+	}
+
+	if conns[true] != 1 {
+		t.Errorf("HTTP/2 used %d connections for %d clients, HTTP/1.1 %d, want them all multiplexed on one", conns[true], clients, conns[false])
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// VHostRouter picks the pool for a request by its Host header
+type VHostRouter struct {
+	hosts map[string]*ServerPool
+	// wildcard suffixes like ".example.com", longest first
+	wildcards []string
+	fallback  *ServerPool
+	// pools that no host maps to, reached by name
+	named map[string]*ServerPool
+}
+
+func NewVHostRouter(fallback *ServerPool) *VHostRouter {
+	return &VHostRouter{hosts: make(map[string]*ServerPool), named: make(map[string]*ServerPool), fallback: fallback}
+}
+
+// AddPool registers a pool by its name
+func (v *VHostRouter) AddPool(pool *ServerPool) {
+	v.named[pool.Name] = pool
+}
+
+// Pool returns the named pool, nil when there is none
+func (v *VHostRouter) Pool(name string) *ServerPool {
+	return v.named[name]
+}
+
+// AddHost registers a pool for a hostname or a wildcard like *.example.com
+func (v *VHostRouter) AddHost(host string, pool *ServerPool) {
+	host = strings.ToLower(host)
+	if strings.HasPrefix(host, "*.") {
+		host = host[1:]
+		v.wildcards = append(v.wildcards, host)
+		sort.Slice(v.wildcards, func(i, j int) bool { return len(v.wildcards[i]) > len(v.wildcards[j]) })
+	}
+	v.hosts[host] = pool
+}
+
+// Match returns the pool for the request host, or the fallback pool
+func (v *VHostRouter) Match(r *http.Request) *ServerPool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	if pool, ok := v.hosts[host]; ok && !strings.HasPrefix(host, ".") {
+		return pool
+	}
+	for _, suffix := range v.wildcards {
+		if strings.HasSuffix(host, suffix) {
+			return v.hosts[suffix]
+		}
+	}
+	return v.fallback
+}
+
+// Pools lists every pool once, the fallback first
+func (v *VHostRouter) Pools() []*ServerPool {
+	var pools []*ServerPool
+	seen := make(map[*ServerPool]bool)
+	if v.fallback != nil {
+		pools = append(pools, v.fallback)
+		seen[v.fallback] = true
+	}
+
+	var others []*ServerPool
+	for _, hosts := range []map[string]*ServerPool{v.hosts, v.named} {
+		for _, pool := range hosts {
+			if !seen[pool] {
+				others = append(others, pool)
+				seen[pool] = true
+			}
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].Name < others[j].Name })
+	return append(pools, others...)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type windowBucket struct {
+	second int64
+	total  int64
+	errors int64
+}
+
+// slidingWindow counts events over the last few seconds in per-second buckets
+type slidingWindow struct {
+	mux     sync.Mutex
+	buckets []windowBucket
+}
+
+func newSlidingWindow(size time.Duration) *slidingWindow {
+	seconds := int(size / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &slidingWindow{buckets: make([]windowBucket, seconds)}
+}
+
+func (w *slidingWindow) Add(now time.Time, failed bool) {
+	second := now.Unix()
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	b := &w.buckets[second%int64(len(w.buckets))]
+	if b.second != second {
+		*b = windowBucket{second: second}
+	}
+	b.total++
+	if failed {
+		b.errors++
+	}
+}
+
+// Counts returns the events and failed events seen within the window
+func (w *slidingWindow) Counts(now time.Time) (total, errors int64) {
+	oldest := now.Unix() - int64(len(w.buckets))
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	for _, b := range w.buckets {
+		if b.second > oldest {
+			total += b.total
+			errors += b.errors
+		}
+	}
+	return total, errors
+}
+
+func (w *slidingWindow) Reset() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	for i := range w.buckets {
+		w.buckets[i] = windowBucket{}
+	}
+}
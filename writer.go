@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// statusWriter remembers the status code written to the client
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack on the underlying writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// responseBuffer holds a proxied response in memory, so that hedged attempts
+// can race without writing to the client and replayed ones can be inspected
+type responseBuffer struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header)}
+}
+
+func (rb *responseBuffer) Header() http.Header {
+	return rb.header
+}
+
+func (rb *responseBuffer) WriteHeader(code int) {
+	if rb.code == 0 {
+		rb.code = code
+	}
+}
+
+func (rb *responseBuffer) Write(b []byte) (int, error) {
+	rb.WriteHeader(http.StatusOK)
+	return rb.body.Write(b)
+}
+
+func (rb *responseBuffer) writeTo(w http.ResponseWriter) {
+	for name, values := range rb.header {
+		w.Header()[name] = values
+	}
+	if rb.code == 0 {
+		rb.code = http.StatusOK
+	}
+	w.WriteHeader(rb.code)
+	w.Write(rb.body.Bytes())
+}